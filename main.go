@@ -1,19 +1,58 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/meepshop/go-db-migration/pkg/backup"
+	"github.com/meepshop/go-db-migration/pkg/database"
 	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+	"github.com/meepshop/go-db-migration/pkg/history"
+	"github.com/meepshop/go-db-migration/pkg/jsPlugin"
+	"github.com/meepshop/go-db-migration/pkg/lock"
+	"github.com/meepshop/go-db-migration/pkg/logger"
+	"github.com/meepshop/go-db-migration/pkg/metrics"
+	"github.com/meepshop/go-db-migration/pkg/pipePlugin"
+	"github.com/meepshop/go-db-migration/pkg/pluginHarness"
 	"github.com/meepshop/go-db-migration/pkg/recover"
+	"github.com/meepshop/go-db-migration/pkg/rpcPlugin"
+	"github.com/meepshop/go-db-migration/pkg/throttle"
+	"github.com/meepshop/go-db-migration/pkg/transform"
+	"github.com/meepshop/go-db-migration/pkg/transformer"
+	"github.com/meepshop/go-db-migration/pkg/wasmPlugin"
+
+	_ "github.com/meepshop/go-db-migration/pkg/migrations"
 )
 
-// go run main.go --query="select * from users" | ./testPlugin.js | go run main.go --consumer
-// go run main.go --recover=20171222085205
+// go run main.go --query="select * from users" | ./testPlugin.js | go run main.go --consumer --dedup
+// go run main.go --query="SELECT id, data FROM users" --envelope | ./versionedPlugin.js | go run main.go --consumer
+// go run main.go --run="SELECT id, data FROM users" --transform=spec.yaml
+// go run main.go --run="SELECT id, data FROM users" --transformer=example
+// go run main.go --run="SELECT id, data FROM users" --js=./pluginExample --workers=4
+// go run main.go --run="SELECT id, data FROM users" --wasm=plugin.wasm --wasm-memory=64
+// go run main.go --run="SELECT id, data FROM users" --plugin=./pluginRpcExample --skip-errors
+// go run main.go plugin test --fixtures=rows.ndjson --golden=expected.json --pipe=./pluginExample
+// go run main.go backups verify
+// go run main.go backups prune --keep-last=10 --older-than=720h
+// go run main.go --recover=01JAB3QK2H7M4X9R8T6V5W2Y1Z --table=product --where='[{path: storeId, op: eq, value: abc}]'
+// go run main.go --recover=01JAB3QK2H7M4X9R8T6V5W2Y1Z --dry-run --on-conflict=skip
+// go run main.go --recover=01JAB3QK2H7M4X9R8T6V5W2Y1Z --lock=global --lock-wait=5m
 
 func main() {
 
+	if err := logger.SetupFromEnv(); err != nil {
+		log.Println(err)
+	}
+
 	if len(os.Args) < 2 {
 		log.Println("no illegal action")
 	}
@@ -22,30 +61,589 @@ func main() {
 	switch params[0] {
 	case "--query":
 
+		flags := flag.NewFlagSet("query", flag.ExitOnError)
+		envelope := flags.Bool("envelope", false, "output {\"id\", \"version\", \"data\"} per row for version checked migrations")
+		flags.Parse(os.Args[2:])
+
 		// 確認是SELECT開頭之Query
 		if index := strings.Index(os.Args[1][8:], "SELECT"); index != 0 {
 			log.Println("Query format error")
 		} else {
-			dbMigration.QueryDataAndOutput(os.Args[1][8:])
+			dbMigration.QueryDataAndOutput(os.Args[1][8:], *envelope)
+		}
+
+	case "--run":
+
+		// 確認是SELECT開頭之Query
+		query := strings.TrimPrefix(os.Args[1], "--run=")
+		if index := strings.Index(query, "SELECT"); index != 0 {
+			log.Println("Query format error")
+			break
+		}
+
+		flags := flag.NewFlagSet("run", flag.ExitOnError)
+		opts := transformerOptions{}
+		opts.register(flags)
+		mOpts := migrationOptions{}
+		mOpts.register(flags)
+		flags.Parse(os.Args[2:])
+
+		t, err := opts.newTransformer()
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+
+		mgt, err := mOpts.newMigration()
+		if err == nil {
+			mgt.HandleSignals()
+			mgt.Workers = opts.workers
+			mgt.SkipErrors = opts.skipErrors
+			mgt.Plugin, mgt.PluginHash = opts.source()
+			if err = mOpts.apply(&mgt); err == nil && mOpts.count {
+				err = mgt.CountQuery(query)
+			}
+			if err == nil {
+				err = mgt.ProcTransform(context.Background(), query, t.Transform)
+			}
+		}
+		mgt.Close()
+
+		if c, ok := t.(interface{ Close() }); ok {
+			c.Close()
+		}
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+
+	case "plugin":
+
+		if len(os.Args) < 3 || os.Args[2] != "test" {
+			log.Println("usage: plugin test --fixtures=rows.ndjson --golden=expected.json [--update] <plugin options>")
+			break
+		}
+
+		flags := flag.NewFlagSet("plugin test", flag.ExitOnError)
+		fixtures := flags.String("fixtures", "", "fixture rows, one json object per line")
+		golden := flags.String("golden", "", "golden expected output file")
+		update := flags.Bool("update", false, "record a new golden file instead of comparing")
+		opts := transformerOptions{}
+		opts.register(flags)
+		flags.Parse(os.Args[3:])
+
+		if *fixtures == "" || *golden == "" {
+			log.Println("--fixtures and --golden are required")
+			os.Exit(2)
+		}
+
+		t, err := opts.newTransformer()
+		if err != nil {
+			log.Println(err)
+			os.Exit(2)
+		}
+
+		ok, err := pluginHarness.Run(context.Background(), t, *fixtures, *golden, *update, os.Stdout)
+		if c, isCloser := t.(interface{ Close() }); isCloser {
+			c.Close()
+		}
+		if err != nil {
+			log.Println(err)
+			os.Exit(2)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+
+	case "history":
+
+		flags := flag.NewFlagSet("history", flag.ExitOnError)
+		limit := flags.Int("limit", 20, "number of runs listed")
+		args := os.Args[2:]
+		show := len(args) > 0 && args[0] == "show"
+		if show {
+			args = args[1:]
+		}
+		flags.Parse(args)
+
+		if show && flags.NArg() != 1 {
+			log.Println("usage: history show <run id>")
+			os.Exit(2)
+		}
+
+		db, err := database.NewPGConn()
+		if err != nil {
+			os.Exit(2)
+		}
+		defer db.Close()
+
+		if show {
+			err = printRun(db, flags.Arg(0))
+		} else {
+			err = printRuns(db, *limit)
+		}
+		if err != nil {
+			log.Println(err)
+			os.Exit(2)
+		}
+
+	case "backups":
+
+		flags := flag.NewFlagSet("backups", flag.ExitOnError)
+		dir := flags.String("dir", backup.Dir, "backup directory")
+		samples := flags.Int("samples", 3, "records shown per table (show)")
+		keepLast := flags.Int("keep-last", 0, "always keep the newest n backups (prune)")
+		olderThan := flags.Duration("older-than", 0, "remove backups older than this, e.g. 720h (prune)")
+		dryRun := flags.Bool("dry-run", false, "only list the backups that would be removed (prune)")
+		force := flags.Bool("force", false, "also remove backups without a final status, which may still be written (prune)")
+		args := os.Args[2:]
+		action := "list"
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			action, args = args[0], args[1:]
+		}
+		flags.Parse(args)
+
+		var err error
+		switch action {
+		case "list":
+			err = printBackups(*dir)
+		case "show":
+			if flags.NArg() != 1 {
+				log.Println("usage: backups show <run id>")
+				os.Exit(2)
+			}
+			err = printBackup(*dir, flags.Arg(0), *samples)
+		case "verify":
+			err = verifyBackups(*dir, flags.Args())
+		case "prune":
+			err = pruneBackups(*dir, backup.PruneRules{KeepLast: *keepLast, OlderThan: *olderThan, Force: *force, DryRun: *dryRun})
+		default:
+			err = errors.New("usage: backups [list|show|verify|prune]")
+		}
+		if err != nil {
+			log.Println(err)
+			os.Exit(2)
 		}
 
 	case "--recover":
 
+		flags := flag.NewFlagSet("recover", flag.ExitOnError)
+		lOpts := lockOptions{}
+		lOpts.register(flags)
+		tables := flags.String("table", "", "only recover these tables, comma separated")
+		ids := flags.String("ids", "", "only recover these ids, comma separated")
+		idsFile := flags.String("ids-file", "", "file of ids to recover, one per line")
+		where := flags.String("where", "", "only recover ids whose original data matches these conditions, same format as the transform spec when")
+		dryRun := flags.Bool("dry-run", false, "only list what would be deleted or restored and the records modified since the migration")
+		onConflict := flags.String("on-conflict", recover.OnConflictReport, "records modified since the migration: report (stop without changes), skip or force")
+		flags.Parse(os.Args[2:])
+
+		filter, err := recover.NewFilter(*tables, *ids, *idsFile, *where)
+		if err != nil {
+			log.Println(err)
+			os.Exit(2)
+		}
+
 		rc, err := recover.NewRecover(params[1])
 		if err == nil {
-			rc.ProcRecover()
+			rc.Lock, rc.LockWait = lOpts.mode, lOpts.wait
+			rc.Filter = filter
+			rc.DryRun, rc.OnConflict = *dryRun, *onConflict
+			err = rc.ProcRecover()
 		}
 		rc.Close()
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
 
 	case "--consumer":
 
-		mgt, err := dbMigration.NewMigration()
+		flags := flag.NewFlagSet("consumer", flag.ExitOnError)
+		mOpts := migrationOptions{}
+		mOpts.register(flags)
+		sourceQuery := flags.String("source-query", "", "query piped into the plugin, recorded in migration_runs")
+		sourcePlugin := flags.String("source-plugin", "", "plugin file producing the input, recorded with its hash in migration_runs")
+		flags.Parse(os.Args[2:])
+
+		mgt, err := mOpts.newMigration()
 		if err == nil {
-			mgt.ProcDbBigration()
+			mgt.HandleSignals()
+			mgt.SourceQuery = *sourceQuery
+			if *sourcePlugin != "" {
+				mgt.Plugin, mgt.PluginHash = *sourcePlugin, history.FileHash(*sourcePlugin)
+			}
+			if err = mOpts.apply(&mgt); err == nil {
+				err = mgt.ProcDbBigration()
+			}
 		}
 		mgt.Close()
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
 
 	default:
 		log.Println("no illegal action")
 	}
 }
+
+// migrationOptions 寫入方式的參數，--run 與 --consumer 共用
+type migrationOptions struct {
+	dedup           bool
+	parentFirst     bool
+	checkVersion    bool
+	conflictRetries int
+
+	limits         throttle.Limits
+	bulkLatency    time.Duration
+	replicationLag time.Duration
+	throttleFile   string
+
+	resume string
+
+	progress time.Duration
+	total    int
+	count    bool
+
+	metricsAddr string
+
+	lock lockOptions
+}
+
+func (o *migrationOptions) register(flags *flag.FlagSet) {
+	flags.BoolVar(&o.dedup, "dedup", false, "keep only the last UPSERT or DELETE of the same table and id within a batch")
+	flags.BoolVar(&o.parentFirst, "parent-first", false, "write tables without parent before tables with parent within a batch")
+	flags.BoolVar(&o.checkVersion, "check-version", false, "only write rows unchanged since the query (--run)")
+	flags.IntVar(&o.conflictRetries, "conflict-retries", 3, "times a conflicting row is transformed again from its current data before being reported (--run)")
+	flags.Float64Var(&o.limits.RecordsPerSec, "max-records-per-sec", 0, "maximum records written per second, 0 for unlimited")
+	flags.Float64Var(&o.limits.BatchesPerSec, "max-batches-per-sec", 0, "maximum batches written per second, 0 for unlimited")
+	flags.DurationVar(&o.bulkLatency, "max-bulk-latency", 0, "slow down when an ES bulk takes longer than this")
+	flags.DurationVar(&o.replicationLag, "max-replication-lag", 0, "slow down while PG replication lag is above this")
+	flags.StringVar(&o.throttleFile, "throttle-file", "", "yaml or json file overriding the limits, reloaded on change or SIGHUP")
+	flags.StringVar(&o.resume, "resume", "", "resume token printed by a stopped run")
+	flags.DurationVar(&o.progress, "progress", 10*time.Second, "interval of progress output on stderr, 0 to disable")
+	flags.IntVar(&o.total, "total", 0, "number of inputs expected, used for the ETA")
+	flags.BoolVar(&o.count, "count", false, "count the query rows first for the ETA (--run)")
+	flags.StringVar(&o.metricsAddr, "metrics-addr", "", "serve prometheus metrics on this address, e.g. :9100")
+	o.lock.register(flags)
+}
+
+// lockOptions advisory lock 的參數，--run、--consumer 與 --recover 共用
+type lockOptions struct {
+	mode string
+	wait time.Duration
+}
+
+func (o *lockOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.mode, "lock", lock.ModeTable, "advisory lock held while writing: table, global or none")
+	flags.DurationVar(&o.wait, "lock-wait", 0, "wait up to this long for a lock held by another run, 0 to fail fast")
+}
+
+func (o migrationOptions) newMigration() (dbMigration.Migration, error) {
+
+	if o.resume != "" {
+		return dbMigration.ResumeMigration(o.resume)
+	}
+
+	return dbMigration.NewMigration()
+}
+
+func (o migrationOptions) apply(m *dbMigration.Migration) error {
+
+	m.Dedup = o.dedup
+	m.ParentFirst = o.parentFirst
+	m.CheckVersion = o.checkVersion
+	m.ConflictRetries = o.conflictRetries
+	m.Progress = o.progress
+	m.Lock, m.LockWait = o.lock.mode, o.lock.wait
+	if o.metricsAddr != "" {
+		metrics.Serve(o.metricsAddr)
+	}
+	if o.total > 0 {
+		m.SetTotal(o.total)
+	}
+
+	limits := o.limits
+	limits.MaxBulkLatencyMs = int64(o.bulkLatency / time.Millisecond)
+	limits.MaxReplicationLagMs = int64(o.replicationLag / time.Millisecond)
+	if limits == (throttle.Limits{}) && o.throttleFile == "" {
+		return nil
+	}
+
+	// 以 migration 的連線讀取 pg_stat_replication，隨 migration 關閉
+	t, err := throttle.New(limits, o.throttleFile, m.DB())
+	if err != nil {
+		return err
+	}
+	m.Throttle = t
+
+	return nil
+}
+
+// transformerOptions 選擇轉換方式的參數，--transform、--transformer、--js、--wasm、--plugin、--pipe 擇一
+type transformerOptions struct {
+	spec        string
+	name        string
+	js          string
+	jsTimeout   time.Duration
+	wasm        string
+	wasmMemory  int
+	wasmTimeout time.Duration
+
+	plugin        string
+	pluginTimeout time.Duration
+	pipe          string
+
+	workers    int
+	skipErrors bool
+}
+
+func (o *transformerOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.spec, "transform", "", "transform spec file (yaml or json)")
+	flags.StringVar(&o.name, "transformer", "", "registered transformer name")
+	flags.StringVar(&o.js, "js", "", "node plugin file run in the embedded js runtime")
+	flags.DurationVar(&o.jsTimeout, "js-timeout", 10*time.Second, "timeout of each js plugin call")
+	flags.StringVar(&o.wasm, "wasm", "", "wasm plugin file run in the sandboxed wasm runtime")
+	flags.IntVar(&o.wasmMemory, "wasm-memory", 64, "memory limit of each wasm plugin instance in MB")
+	flags.DurationVar(&o.wasmTimeout, "wasm-timeout", 10*time.Second, "timeout of each wasm plugin call")
+	flags.StringVar(&o.plugin, "plugin", "", "long-lived plugin command speaking the json-rpc protocol")
+	flags.DurationVar(&o.pluginTimeout, "plugin-timeout", 30*time.Second, "time without reply before the plugin is considered hung and restarted")
+	flags.StringVar(&o.pipe, "pipe", "", "plugin command speaking the same stdin/stdout protocol as --consumer")
+	flags.IntVar(&o.workers, "workers", 1, "number of rows transformed concurrently")
+	flags.BoolVar(&o.skipErrors, "skip-errors", false, "skip rows the transformer fails on instead of stopping")
+}
+
+// source 記錄於 migration_runs 的 plugin 與其檔案的 hash
+func (o transformerOptions) source() (string, string) {
+
+	switch {
+	case o.spec != "":
+		return "transform:" + o.spec, history.FileHash(o.spec)
+	case o.name != "":
+		return "transformer:" + o.name, ""
+	case o.js != "":
+		return "js:" + o.js, history.FileHash(o.js)
+	case o.wasm != "":
+		return "wasm:" + o.wasm, history.FileHash(o.wasm)
+	case o.pipe != "":
+		return "pipe:" + o.pipe, history.FileHash(strings.Fields(o.pipe)[0])
+	case o.plugin != "":
+		return "plugin:" + o.plugin, history.FileHash(strings.Fields(o.plugin)[0])
+	}
+
+	return "", ""
+}
+
+func (o transformerOptions) newTransformer() (transformer.Transformer, error) {
+
+	set := 0
+	for _, v := range []string{o.spec, o.name, o.js, o.wasm, o.plugin, o.pipe} {
+		if v != "" {
+			set += 1
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("exactly one of --transform, --transformer, --js, --wasm, --plugin or --pipe is required")
+	}
+
+	switch {
+	case o.spec != "":
+		return transform.LoadSpec(o.spec)
+	case o.name != "":
+		return transformer.Get(o.name)
+	case o.js != "":
+		return jsPlugin.Load(o.js, o.workers, o.jsTimeout)
+	case o.wasm != "":
+		return wasmPlugin.Load(o.wasm, o.workers, o.wasmMemory, o.wasmTimeout)
+	case o.pipe != "":
+		return pipePlugin.Load(o.pipe)
+	default:
+		// 未設定PG時 plugin 無法使用 lookup
+		db, err := database.NewPGConn()
+		if err != nil {
+			log.Println("plugin lookup disabled")
+			db = nil
+		}
+		return rpcPlugin.Load(o.plugin, o.pluginTimeout, db)
+	}
+}
+
+// printRuns 列出最近的執行記錄
+func printRuns(db *sql.DB, limit int) error {
+
+	runs, err := history.List(db, limit)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN\tSTARTED\tFINISHED\tSTATUS\tOPERATOR\tCOMMAND\tPLUGIN")
+	for _, run := range runs {
+		finished := "-"
+		if run.FinishedAt != nil {
+			finished = run.FinishedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", run.RunId, run.StartedAt.Format(time.RFC3339), finished, run.Status, run.Operator, run.Command, run.Plugin)
+	}
+
+	return w.Flush()
+}
+
+// printRun 以 JSON 輸出一筆執行記錄
+func printRun(db *sql.DB, runId string) error {
+
+	run, err := history.Get(db, runId)
+	if err == sql.ErrNoRows {
+		return errors.New("run not found: " + runId)
+	} else if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+
+	return nil
+}
+
+// printBackups 列出備份目錄內的備份
+func printBackups(dir string) error {
+
+	list, err := backup.LoadAll(dir)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN\tTIME\tSTATUS\tRECORDS\tCHANGED\tSIZE\tTABLES")
+	for _, b := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", b.RunId, b.Time.Format(time.RFC3339), b.Status, b.Records, b.Changed, byteSize(b.Size), strings.Join(b.TableNames(), ","))
+	}
+
+	return w.Flush()
+}
+
+// printBackup 輸出一個備份各 table 的筆數、執行報告及部分原資料
+func printBackup(dir string, id string, samples int) error {
+
+	b, err := backup.Load(dir, id)
+	if err != nil {
+		return err
+	}
+	records, err := backup.Samples(dir, id, samples)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Run:     %s\nTime:    %s\nStatus:  %s\nSize:    %s\nFiles:   %s\n\n", b.RunId, b.Time.Format(time.RFC3339), b.Status, byteSize(b.Size), strings.Join(b.Files, ", "))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tRECORDS\tCHANGED")
+	for _, name := range b.TableNames() {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", name, b.Tables[name].Records, b.Tables[name].Changed)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, name := range b.TableNames() {
+		if len(records[name]) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s:\n", name)
+		for _, r := range records[name] {
+			fmt.Printf("  %s  %s\n", r.Id, truncate(r.Data, 120))
+		}
+	}
+
+	if len(b.Summary) > 0 {
+		fmt.Printf("\nSummary:\n%s", b.Summary)
+	}
+
+	return nil
+}
+
+// verifyBackups 檢查指定的備份，未指定時檢查全部，有錯誤時回傳 error
+func verifyBackups(dir string, ids []string) error {
+
+	if len(ids) == 0 {
+		list, err := backup.List(dir)
+		if err != nil {
+			return err
+		}
+		for _, b := range list {
+			ids = append(ids, b.RunId)
+		}
+	}
+
+	failed := 0
+	for _, id := range ids {
+		report, err := backup.Verify(dir, id)
+		if err != nil {
+			return err
+		}
+
+		status := "OK"
+		if len(report.Errors) > 0 {
+			status = "FAILED"
+			failed += 1
+		}
+		fmt.Printf("%s %s: %d records (%d without checksum), %d changed ids, %d post hashes\n", status, id, report.Records, report.Legacy, report.Changed, report.PostHashes)
+		for _, e := range report.Errors {
+			fmt.Println("  " + e)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d backups failed verification", failed, len(ids))
+	}
+
+	return nil
+}
+
+// pruneBackups 依保留規則刪除備份並列出刪除的備份
+func pruneBackups(dir string, rules backup.PruneRules) error {
+
+	removed, skipped, err := backup.Prune(dir, rules)
+	for _, b := range removed {
+		verb := "removed"
+		if rules.DryRun {
+			verb = "would remove"
+		}
+		fmt.Printf("%s %s (%s, %s)\n", verb, b.RunId, b.Time.Format(time.RFC3339), byteSize(b.Size))
+	}
+	for _, b := range skipped {
+		fmt.Printf("kept %s (%s, status %s, use --force to remove)\n", b.RunId, b.Time.Format(time.RFC3339), b.Status)
+	}
+
+	return err
+}
+
+func byteSize(n int64) string {
+
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	size := float64(n)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i += 1
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", n, units[0])
+	}
+
+	return fmt.Sprintf("%.1f%s", size, units[i])
+}
+
+func truncate(s string, n int) string {
+
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+
+	return string(r[:n]) + "..."
+}
@@ -0,0 +1,414 @@
+package backup
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/meepshop/go-db-migration/pkg/utils"
+)
+
+var suffixes = []string{OriginSuffix, UpsertSuffix, PostSuffix, ConflictsSuffix, SummarySuffix}
+
+// Backup 一次執行產生的備份檔
+type Backup struct {
+	RunId  string    `json:"runId"`
+	Time   time.Time `json:"time"`
+	Files  []string  `json:"files"`
+	Size   int64     `json:"size"`
+	Status string    `json:"status"`
+
+	// Records originData 的筆數，Changed upsertID 的 id 數
+	Records int                    `json:"records"`
+	Changed int                    `json:"changed"`
+	Tables  map[string]*TableStats `json:"tables"`
+
+	// Summary 執行結束時寫入的報告，沒有時為空
+	Summary json.RawMessage `json:"summary,omitempty"`
+}
+
+// TableStats 單一 table 備份的筆數
+type TableStats struct {
+	Records int `json:"records"`
+	Changed int `json:"changed"`
+}
+
+// Report verify 的結果
+type Report struct {
+	RunId   string `json:"runId"`
+	Records int    `json:"records"`
+	Legacy  int    `json:"legacy"`
+	Changed int    `json:"changed"`
+	// PostHashes postHash 的筆數，舊版備份沒有
+	PostHashes int      `json:"postHashes"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// maxErrors 每個備份最多列出的錯誤數
+const maxErrors = 20
+
+func (r *Report) fail(format string, args ...interface{}) {
+
+	if len(r.Errors) == maxErrors {
+		r.Errors = append(r.Errors, "...")
+	}
+	if len(r.Errors) < maxErrors {
+		r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+// TableNames 依名稱排序的 table
+func (b Backup) TableNames() []string {
+
+	names := []string{}
+	for name := range b.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// List 依時間由新到舊列出目錄內的備份，只讀取檔案資訊與報告
+func List(dir string) ([]Backup, error) {
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Printf("Read backup dir error: %+v", err)
+		return nil, err
+	}
+
+	backups := map[string]*Backup{}
+	for _, entry := range entries {
+		for _, suffix := range suffixes {
+			id := strings.TrimSuffix(entry.Name(), suffix)
+			if id == entry.Name() || !utils.IsRunId(id) {
+				continue
+			}
+			b, ok := backups[id]
+			if !ok {
+				b = &Backup{RunId: id, Time: utils.RunIdTime(id), Status: "unknown"}
+				backups[id] = b
+			}
+			b.Files = append(b.Files, entry.Name())
+			b.Size += entry.Size()
+		}
+	}
+
+	list := []Backup{}
+	for _, b := range backups {
+		b.loadSummary(dir)
+		list = append(list, *b)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Time.Equal(list[j].Time) {
+			return list[i].Time.After(list[j].Time)
+		}
+		return list[i].RunId > list[j].RunId
+	})
+
+	return list, nil
+}
+
+// Load 讀取一個備份，並計算各 table 的筆數
+func Load(dir string, id string) (Backup, error) {
+
+	list, err := List(dir)
+	if err != nil {
+		return Backup{}, err
+	}
+	for _, b := range list {
+		if b.RunId == id {
+			return b, b.count(dir)
+		}
+	}
+
+	return Backup{}, fmt.Errorf("backup not found: %s", id)
+}
+
+// LoadAll 讀取目錄內所有備份，並計算各 table 的筆數
+func LoadAll(dir string) ([]Backup, error) {
+
+	list, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if err := list[i].count(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	return list, nil
+}
+
+func (b *Backup) loadSummary(dir string) {
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, b.RunId+SummarySuffix))
+	if err != nil {
+		return
+	}
+
+	var summary struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(raw, &summary); err != nil {
+		return
+	}
+	b.Status = summary.Status
+	b.Summary = json.RawMessage(raw)
+}
+
+func (b *Backup) count(dir string) error {
+
+	b.Tables = map[string]*TableStats{}
+	stats := func(name string) *TableStats {
+		if b.Tables[name] == nil {
+			b.Tables[name] = &TableStats{}
+		}
+		return b.Tables[name]
+	}
+
+	err := ReadRecords(dir, b.RunId, func(line int, r Record, err error) error {
+		if err == nil {
+			b.Records += 1
+			stats(r.Table).Records += 1
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return ReadChanges(dir, b.RunId, func(line int, table string, ids []string) error {
+		b.Changed += len(ids)
+		stats(table).Changed += len(ids)
+		return nil
+	})
+}
+
+// Samples 各 table 前 n 筆原資料
+func Samples(dir string, id string, n int) (map[string][]Record, error) {
+
+	samples := map[string][]Record{}
+	err := ReadRecords(dir, id, func(line int, r Record, err error) error {
+		if err == nil && len(samples[r.Table]) < n {
+			samples[r.Table] = append(samples[r.Table], r)
+		}
+		return nil
+	})
+
+	return samples, err
+}
+
+// ReadRecords 逐行讀取 originData，解析失敗時 err 不為空，fn 回傳錯誤即中斷
+func ReadRecords(dir string, id string, fn func(line int, r Record, err error) error) error {
+
+	return readLines(filepath.Join(dir, id+OriginSuffix), func(n int, line string, truncated bool) error {
+		r, err := ParseRecord(line)
+		if truncated && err == nil {
+			err = fmt.Errorf("truncated record")
+		}
+		return fn(n, r, err)
+	})
+}
+
+// ReadPostHashes 逐行讀取 postHash，檔案不存在時回傳 os.ErrNotExist
+func ReadPostHashes(dir string, id string, fn func(line int, p PostHash, err error) error) error {
+
+	path := filepath.Join(dir, id+PostSuffix)
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	return readLines(path, func(n int, line string, truncated bool) error {
+		p, err := ParsePostHash(line)
+		if truncated && err == nil {
+			err = fmt.Errorf("truncated record")
+		}
+		return fn(n, p, err)
+	})
+}
+
+// readLines 逐行讀取，最後一行沒有換行代表寫入中斷，檔案不存在時略過
+func readLines(path string, fn func(n int, line string, truncated bool) error) error {
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			if err := fn(n, line, err == io.EOF); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			log.Print(err)
+			return err
+		}
+	}
+}
+
+// ReadChanges 讀取 upsertID，每兩行為 table 與以逗號分隔的 id
+func ReadChanges(dir string, id string, fn func(line int, table string, ids []string) error) error {
+
+	f, err := os.Open(filepath.Join(dir, id+UpsertSuffix))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	table := ""
+	n := 0
+	for scanner.Scan() {
+		n += 1
+		if n%2 == 1 {
+			table = scanner.Text()
+			continue
+		}
+		if err := fn(n-1, table, strings.Split(scanner.Text(), ",")); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Print(err)
+		return err
+	}
+	if n%2 == 1 {
+		return fn(n, table, nil)
+	}
+
+	return nil
+}
+
+// Verify 解析備份內的每一筆資料並檢查 checksum
+func Verify(dir string, id string) (Report, error) {
+
+	report := Report{RunId: id}
+
+	err := ReadRecords(dir, id, func(line int, r Record, err error) error {
+		if err != nil {
+			report.fail("%s line %d: %v", OriginSuffix, line, err)
+			return nil
+		}
+		report.Records += 1
+		if !r.Checksum {
+			report.Legacy += 1
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	err = ReadChanges(dir, id, func(line int, table string, ids []string) error {
+		switch {
+		case table == "":
+			report.fail("%s line %d: table is empty", UpsertSuffix, line)
+		case ids == nil:
+			report.fail("%s line %d: ids of table %s are missing", UpsertSuffix, line, table)
+		default:
+			for _, changeId := range ids {
+				if changeId == "" {
+					report.fail("%s line %d: empty id", UpsertSuffix, line+1)
+					break
+				}
+			}
+			report.Changed += len(ids)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	err = ReadPostHashes(dir, id, func(line int, p PostHash, err error) error {
+		if err != nil {
+			report.fail("%s line %d: %v", PostSuffix, line, err)
+			return nil
+		}
+		report.PostHashes += 1
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return report, nil
+	}
+
+	return report, err
+}
+
+// PruneRules 保留規則
+type PruneRules struct {
+	// KeepLast 最新的 n 個一律保留
+	KeepLast int
+	// OlderThan 超過的刪除，未設定時刪除 KeepLast 以外的全部
+	OlderThan time.Duration
+	// Force 連同沒有執行結果的備份一起刪除，這些可能是仍在執行中的備份
+	Force bool
+	// DryRun 只回傳會刪除的備份
+	DryRun bool
+}
+
+// finished 有執行結果的狀態
+var finished = map[string]bool{"completed": true, "stopped": true, "failed": true}
+
+// Prune 依保留規則刪除備份，回傳刪除的備份，以及因沒有執行結果而保留的備份
+func Prune(dir string, rules PruneRules) ([]Backup, []Backup, error) {
+
+	if rules.KeepLast <= 0 && rules.OlderThan <= 0 {
+		return nil, nil, fmt.Errorf("prune requires --keep-last or --older-than")
+	}
+
+	list, err := List(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	removed, skipped := []Backup{}, []Backup{}
+	for i, b := range list {
+		if rules.KeepLast > 0 && i < rules.KeepLast {
+			continue
+		}
+		if rules.OlderThan > 0 && time.Since(b.Time) <= rules.OlderThan {
+			continue
+		}
+		if !finished[b.Status] && !rules.Force {
+			skipped = append(skipped, b)
+			continue
+		}
+		if !rules.DryRun {
+			for _, name := range b.Files {
+				if err := os.Remove(filepath.Join(dir, name)); err != nil {
+					log.Printf("Remove backup error: %+v", err)
+					return removed, skipped, err
+				}
+			}
+		}
+		removed = append(removed, b)
+	}
+
+	return removed, skipped, nil
+}
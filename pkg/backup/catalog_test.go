@@ -0,0 +1,247 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/meepshop/go-db-migration/pkg/utils"
+)
+
+// testBackup 建立備份檔，status 為空時不寫入報告
+func testBackup(t *testing.T, dir string, id string, status string, files map[string]string) {
+
+	t.Helper()
+
+	if status != "" {
+		files[SummarySuffix] = `{"status": "` + status + `"}`
+	}
+	for suffix, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, id+suffix), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func tempDir(t *testing.T) string {
+
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+func TestVerify(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		files  map[string]string
+		report Report
+	}{
+		{
+			name: "valid",
+			files: map[string]string{
+				OriginSuffix: FormatRecord("orders", "o1", "", `{}`, "", "") + "orders!@#o2!@#!@#{}\n",
+				UpsertSuffix: "orders\no1,o2,o3\n",
+				PostSuffix:   FormatPostHash("orders", "o1", "h1") + FormatPostHash("orders", "o3", ""),
+			},
+			report: Report{Records: 2, Legacy: 1, Changed: 3, PostHashes: 2},
+		},
+		{
+			name: "legacy without post hashes",
+			files: map[string]string{
+				OriginSuffix: "orders!@#o1!@#!@#{}\n",
+				UpsertSuffix: "orders\no1\n",
+			},
+			report: Report{Records: 1, Legacy: 1, Changed: 1},
+		},
+		{
+			name: "corrupted",
+			files: map[string]string{
+				OriginSuffix: FormatRecord("orders", "o1", "", `{}`, "", "")[:12] + "\n" + FormatRecord("orders", "o2", "", `{}`, "", "") + FormatRecord("orders", "o3", "", `{}`, "", "")[:30],
+				UpsertSuffix: "orders\no1,,o2\n\n",
+				PostSuffix:   "orders!@#o1!@#h1\n",
+			},
+			report: Report{Records: 1, Changed: 3, Errors: []string{
+				"_originData line 1: expected at least 4 fields, got 2",
+				"_originData line 3: truncated record",
+				"_upsertID line 2: empty id",
+				"_upsertID line 3: table is empty",
+				"_postHash line 1: invalid post hash record",
+			}},
+		},
+		{
+			name: "missing ids",
+			files: map[string]string{
+				UpsertSuffix: "orders\no1\nusers",
+			},
+			report: Report{Changed: 1, Errors: []string{"_upsertID line 3: ids of table users are missing"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			dir := tempDir(t)
+			id := utils.NewRunId(time.Now())
+			testBackup(t, dir, id, "", tt.files)
+
+			report, err := Verify(dir, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.report.RunId = id
+			if !reflect.DeepEqual(report, tt.report) {
+				t.Errorf("Verify = %+v, want %+v", report, tt.report)
+			}
+		})
+	}
+}
+
+func TestListAndLoad(t *testing.T) {
+
+	dir := tempDir(t)
+	now := time.Now()
+	older := utils.NewRunId(now.Add(-time.Hour))
+	newer := utils.NewRunId(now)
+	legacy := "20180321093000"
+
+	testBackup(t, dir, older, "completed", map[string]string{
+		OriginSuffix: FormatRecord("orders", "o1", "", `{}`, "", "") + FormatRecord("users", "u1", "", `{}`, "", ""),
+		UpsertSuffix: "orders\no1,o2\nusers\nu1\n",
+	})
+	testBackup(t, dir, newer, "", map[string]string{OriginSuffix: ""})
+	testBackup(t, dir, legacy, "", map[string]string{UpsertSuffix: "orders\no1\n"})
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes_upsertID"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, statuses := []string{}, []string{}
+	for _, b := range list {
+		ids = append(ids, b.RunId)
+		statuses = append(statuses, b.Status)
+	}
+	if want := []string{newer, older, legacy}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("List ids = %v, want %v", ids, want)
+	}
+	if want := []string{"unknown", "completed", "unknown"}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("List statuses = %v, want %v", statuses, want)
+	}
+
+	b, err := Load(dir, older)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(b.Files)
+	want := []string{older + OriginSuffix, older + UpsertSuffix, older + SummarySuffix}
+	sort.Strings(want)
+	if !reflect.DeepEqual(b.Files, want) {
+		t.Errorf("Files = %v, want %v", b.Files, want)
+	}
+	if b.Records != 2 || b.Changed != 3 || *b.Tables["orders"] != (TableStats{Records: 1, Changed: 2}) || *b.Tables["users"] != (TableStats{Records: 1, Changed: 1}) {
+		t.Errorf("Load = %+v, orders %+v, users %+v", b, b.Tables["orders"], b.Tables["users"])
+	}
+
+	if _, err := Load(dir, utils.NewRunId(now.Add(time.Hour))); err == nil {
+		t.Error("Load of a missing backup should fail")
+	}
+}
+
+func TestPrune(t *testing.T) {
+
+	now := time.Now()
+	backups := []struct {
+		id     string
+		status string
+	}{
+		{utils.NewRunId(now.Add(-1 * time.Hour)), "running"},
+		{utils.NewRunId(now.Add(-2 * time.Hour)), "completed"},
+		{utils.NewRunId(now.Add(-48 * time.Hour)), "failed"},
+		{utils.NewRunId(now.Add(-72 * time.Hour)), ""},
+		{"20180321093000", "stopped"},
+	}
+
+	tests := []struct {
+		name    string
+		rules   PruneRules
+		removed []int
+		skipped []int
+		err     bool
+	}{
+		{"no rules", PruneRules{}, nil, nil, true},
+		{"keep last", PruneRules{KeepLast: 2}, []int{2, 4}, []int{3}, false},
+		{"older than", PruneRules{OlderThan: 24 * time.Hour}, []int{2, 4}, []int{3}, false},
+		{"keep last and older than", PruneRules{KeepLast: 3, OlderThan: 90 * time.Minute}, []int{4}, []int{3}, false},
+		{"force", PruneRules{KeepLast: 1, Force: true}, []int{1, 2, 3, 4}, []int{}, false},
+		{"dry run", PruneRules{OlderThan: 30 * time.Minute, DryRun: true}, []int{1, 2, 4}, []int{0, 3}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			dir := tempDir(t)
+			for _, b := range backups {
+				testBackup(t, dir, b.id, b.status, map[string]string{UpsertSuffix: "orders\no1\n"})
+			}
+
+			removed, skipped, err := Prune(dir, tt.rules)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ids := func(list []Backup) []string {
+				s := []string{}
+				for _, b := range list {
+					s = append(s, b.RunId)
+				}
+				return s
+			}
+			indexes := func(is []int) []string {
+				s := []string{}
+				for _, i := range is {
+					s = append(s, backups[i].id)
+				}
+				return s
+			}
+			if got, want := ids(removed), indexes(tt.removed); !reflect.DeepEqual(got, want) {
+				t.Errorf("removed = %v, want %v", got, want)
+			}
+			if got, want := ids(skipped), indexes(tt.skipped); !reflect.DeepEqual(got, want) {
+				t.Errorf("skipped = %v, want %v", got, want)
+			}
+
+			// dry run 不刪除，其餘只刪除回傳的備份
+			left, err := List(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := len(backups) - len(tt.removed)
+			if tt.rules.DryRun {
+				want = len(backups)
+			}
+			if len(left) != want {
+				t.Errorf("%d backups left, want %d", len(left), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+// Dir 備份檔所在的目錄
+const Dir = "backup"
+
+// 欄位分隔符號，以及 originData 每行最後的 checksum 欄位前綴
+const (
+	sep            = "!@#"
+	checksumPrefix = "crc32:"
+)
+
+// 備份檔的種類，檔名為 <run ID><suffix>
+const (
+	OriginSuffix    = "_originData"
+	UpsertSuffix    = "_upsertID"
+	ConflictsSuffix = "_conflicts"
+	SummarySuffix   = "_summary.json"
+	PostSuffix      = "_postHash"
+)
+
+var ErrChecksum = errors.New("checksum mismatch")
+
+// Record originData 的一筆原資料
+type Record struct {
+	Table   string
+	Id      string
+	Parent  string
+	Data    string
+	Columns map[string]interface{}
+
+	// EsBackup 備份檔是否有記錄ES文件，有記錄但 EsData 為空代表原本不存在於ES
+	EsBackup bool
+	EsData   string
+
+	// Checksum 舊版備份檔沒有 checksum
+	Checksum bool
+}
+
+// FormatRecord originData 的一行，最後附上前面內容的 crc32
+func FormatRecord(table string, id string, parent string, data string, columns string, esData string) string {
+	return formatLine(table, id, parent, data, columns, esData)
+}
+
+// ParseRecord 解析 originData 的一行，有 checksum 時一併檢查
+func ParseRecord(line string) (Record, error) {
+
+	o, checksum, err := splitLine(line)
+	if err != nil {
+		return Record{}, err
+	}
+
+	if len(o) < 4 {
+		return Record{}, fmt.Errorf("expected at least 4 fields, got %d", len(o))
+	}
+
+	r := Record{Table: o[0], Id: o[1], Parent: o[2], Data: o[3], Checksum: checksum}
+	if r.Table == "" || r.Id == "" {
+		return r, errors.New("table or id is empty")
+	}
+
+	// 舊版備份檔沒有額外欄位
+	if len(o) > 4 && o[4] != "" {
+		if err := json.Unmarshal([]byte(o[4]), &r.Columns); err != nil {
+			return r, fmt.Errorf("columns: %v", err)
+		}
+	}
+	if len(o) > 5 {
+		r.EsBackup = true
+		r.EsData = o[5]
+	}
+
+	return r, nil
+}
+
+// PostHash migration 寫入後資料的 hash，Hash 為空代表資料已刪除
+type PostHash struct {
+	Table string
+	Id    string
+	Hash  string
+}
+
+// FormatPostHash postHash 的一行
+func FormatPostHash(table string, id string, hash string) string {
+	return formatLine(table, id, hash)
+}
+
+// ParsePostHash 解析 postHash 的一行並檢查 checksum
+func ParsePostHash(line string) (PostHash, error) {
+
+	o, checksum, err := splitLine(line)
+	if err != nil {
+		return PostHash{}, err
+	}
+	if !checksum || len(o) != 3 || o[0] == "" || o[1] == "" {
+		return PostHash{}, fmt.Errorf("invalid post hash record")
+	}
+
+	return PostHash{Table: o[0], Id: o[1], Hash: o[2]}, nil
+}
+
+// formatLine 以分隔符號串接欄位，最後附上前面內容的 crc32
+func formatLine(fields ...string) string {
+
+	line := strings.Join(fields, sep)
+
+	return fmt.Sprintf("%s%s%s%08x\n", line, sep, checksumPrefix, crc32.ChecksumIEEE([]byte(line)))
+}
+
+// splitLine 拆開欄位，有 checksum 時一併檢查，並回傳不含 checksum 的欄位
+func splitLine(line string) ([]string, bool, error) {
+
+	line = strings.TrimRight(line, "\n")
+	o := strings.Split(line, sep)
+
+	// 先檢查 checksum，分隔符號損毀時欄位數也會不同
+	last := o[len(o)-1]
+	if len(o) < 2 || !strings.HasPrefix(last, checksumPrefix) {
+		return o, false, nil
+	}
+
+	body := line[:len(line)-len(last)-len(sep)]
+	if fmt.Sprintf("%s%08x", checksumPrefix, crc32.ChecksumIEEE([]byte(body))) != last {
+		return nil, false, ErrChecksum
+	}
+
+	return o[:len(o)-1], true, nil
+}
@@ -0,0 +1,149 @@
+package backup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRecord(t *testing.T) {
+
+	tests := []struct {
+		name string
+		line string
+		want Record
+		err  bool
+	}{
+		{
+			name: "round trip",
+			line: FormatRecord("orders", "o1", "s1", `{"a": 1}`, `{"status": 2}`, `{"a": 1}`),
+			want: Record{Table: "orders", Id: "o1", Parent: "s1", Data: `{"a": 1}`, Columns: map[string]interface{}{"status": float64(2)}, EsBackup: true, EsData: `{"a": 1}`, Checksum: true},
+		},
+		{
+			name: "not in es",
+			line: FormatRecord("orders", "o1", "", `{}`, "", ""),
+			want: Record{Table: "orders", Id: "o1", Data: `{}`, EsBackup: true, Checksum: true},
+		},
+		{
+			name: "legacy line",
+			line: "orders!@#o1!@#s1!@#{\"a\": 1}\n",
+			want: Record{Table: "orders", Id: "o1", Parent: "s1", Data: `{"a": 1}`},
+		},
+		{
+			name: "legacy line with columns",
+			line: "orders!@#o1!@#!@#{}!@#{\"status\": 1}",
+			want: Record{Table: "orders", Id: "o1", Data: `{}`, Columns: map[string]interface{}{"status": float64(1)}},
+		},
+		{
+			name: "checksum mismatch",
+			line: strings.Replace(FormatRecord("orders", "o1", "", `{"a": 1}`, "", ""), `"a"`, `"b"`, 1),
+			err:  true,
+		},
+		{
+			name: "corrupted separator",
+			line: strings.Replace(FormatRecord("orders", "o1", "", `{}`, "", ""), "!@#o1", "!@o1", 1),
+			err:  true,
+		},
+		{
+			name: "too few fields",
+			line: "orders!@#o1!@#s1\n",
+			err:  true,
+		},
+		{
+			name: "empty id",
+			line: FormatRecord("orders", "", "", `{}`, "", ""),
+			err:  true,
+		},
+		{
+			name: "invalid columns",
+			line: FormatRecord("orders", "o1", "", `{}`, `{`, ""),
+			err:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			r, err := ParseRecord(tt.line)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("ParseRecord(%q) expected error", tt.line)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(r, tt.want) {
+				t.Errorf("ParseRecord(%q) = %+v, want %+v", tt.line, r, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitLine(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		line     string
+		fields   []string
+		checksum bool
+		err      error
+	}{
+		{"with checksum", formatLine("a", "b", ""), []string{"a", "b", ""}, true, nil},
+		{"without trailing newline", strings.TrimSuffix(formatLine("a", "b"), "\n"), []string{"a", "b"}, true, nil},
+		{"legacy", "a!@#b\n", []string{"a", "b"}, false, nil},
+		{"single field", "a\n", []string{"a"}, false, nil},
+		{"field looks like checksum", "a!@#crc32:zz\n", nil, false, ErrChecksum},
+		{"wrong checksum", "a!@#b!@#crc32:00000000\n", nil, false, ErrChecksum},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			fields, checksum, err := splitLine(tt.line)
+			if err != tt.err {
+				t.Fatalf("splitLine(%q) error = %v, want %v", tt.line, err, tt.err)
+			}
+			if !reflect.DeepEqual(fields, tt.fields) || checksum != tt.checksum {
+				t.Errorf("splitLine(%q) = %q, %v, want %q, %v", tt.line, fields, checksum, tt.fields, tt.checksum)
+			}
+		})
+	}
+}
+
+func TestParsePostHash(t *testing.T) {
+
+	tests := []struct {
+		name string
+		line string
+		want PostHash
+		err  bool
+	}{
+		{"round trip", FormatPostHash("orders", "o1", "9e107d9d"), PostHash{Table: "orders", Id: "o1", Hash: "9e107d9d"}, false},
+		{"deleted", FormatPostHash("orders", "o1", ""), PostHash{Table: "orders", Id: "o1"}, false},
+		{"without checksum", "orders!@#o1!@#9e107d9d\n", PostHash{}, true},
+		{"checksum mismatch", strings.Replace(FormatPostHash("orders", "o1", "9e107d9d"), "o1", "o2", 1), PostHash{}, true},
+		{"extra field", formatLine("orders", "o1", "h", "x"), PostHash{}, true},
+		{"empty id", FormatPostHash("orders", "", "h"), PostHash{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			p, err := ParsePostHash(tt.line)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("ParsePostHash(%q) expected error", tt.line)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != tt.want {
+				t.Errorf("ParsePostHash(%q) = %+v, want %+v", tt.line, p, tt.want)
+			}
+		})
+	}
+}
@@ -23,7 +23,8 @@ func NewPGConn() (*sql.DB, error) {
 	pgUser := os.Getenv("POSTGRES_USER")
 	pgPwd := os.Getenv("POSTGRES_PASSWORD")
 	if pgHost == "" || pgUser == "" || pgPwd == "" {
-		log.Printf("POSTGRES_HOST: %s, POSTGRES_USER: %s, POSTGRES_PASSWORD: %s\n", pgHost, pgUser, pgPwd)
+		// 密碼不輸出 只顯示是否設定
+		log.Printf("POSTGRES_HOST: %s, POSTGRES_USER: %s, POSTGRES_PASSWORD set: %t\n", pgHost, pgUser, pgPwd != "")
 		return nil, errors.New("environment variable not set.")
 	}
 
@@ -0,0 +1,88 @@
+package dbMigration
+
+import (
+	"sort"
+
+	"github.com/meepshop/go-db-migration/pkg/utils"
+)
+
+// tableBatch 同一個 table 的資料，依輸入順序排列
+type tableBatch struct {
+	table  string
+	mDatas []MigrationData
+}
+
+func batchKey(mData MigrationData) string {
+	return recordKey(mData.Table, mData.Id)
+}
+
+func recordKey(table string, id string) string {
+	return table + "\x00" + id
+}
+
+// addToBatch 將一筆資料放入批次，同一批次內每個 (table, id) 只會有一筆：
+// Dedup 時 UPSERT、DELETE 取代先前的資料（last-write-wins），
+// 否則先寫入先前的批次，確保依輸入順序套用
+func (m *Migration) addToBatch(mData MigrationData) error {
+
+	if m.batchIndex == nil {
+		m.batchIndex = map[string]int{}
+	}
+
+	key := batchKey(mData)
+	if i, ok := m.batchIndex[key]; ok {
+		if m.Dedup && mData.Action != "UPDATE" {
+			m.dropFromBatch(i)
+		} else if err := m.flush(); err != nil {
+			return err
+		}
+	}
+
+	m.batchIndex[key] = len(m.batch)
+	m.batch = append(m.batch, mData)
+
+	return nil
+}
+
+func (m *Migration) dropFromBatch(i int) {
+
+	m.batch = append(m.batch[:i], m.batch[i+1:]...)
+
+	m.batchIndex = map[string]int{}
+	for j, mData := range m.batch {
+		m.batchIndex[batchKey(mData)] = j
+	}
+}
+
+// groupBatch 將連續相同 table 的資料分為一組，依輸入順序寫入，
+// ParentFirst 時沒有 parent 的組先寫入，有 parent 的組在後
+func (m *Migration) groupBatch() []tableBatch {
+
+	groups := []tableBatch{}
+	for _, mData := range m.batch {
+		if len(groups) == 0 || groups[len(groups)-1].table != mData.Table {
+			groups = append(groups, tableBatch{table: mData.Table})
+		}
+		groups[len(groups)-1].mDatas = append(groups[len(groups)-1].mDatas, mData)
+	}
+
+	if m.ParentFirst {
+		sort.SliceStable(groups, func(i, j int) bool {
+			return !hasParent(groups[i]) && hasParent(groups[j])
+		})
+	}
+
+	return groups
+}
+
+func hasParent(group tableBatch) bool {
+
+	tc := utils.GetTableConfig(group.table)
+	for _, mData := range group.mDatas {
+		if mData.Parent != "" || (mData.Action == "UPSERT" && tc.Parent(mData.Data) != "") {
+			return true
+		}
+	}
+
+	return false
+}
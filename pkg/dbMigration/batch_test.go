@@ -0,0 +1,213 @@
+package dbMigration
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/meepshop/go-db-migration/pkg/backup"
+	"github.com/meepshop/go-db-migration/pkg/utils"
+)
+
+func TestGroupBatch(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		batch       []MigrationData
+		parentFirst bool
+		want        map[string][]string
+		order       []string
+	}{
+		{
+			name: "consecutive runs",
+			batch: []MigrationData{
+				{Table: "b", Action: "UPSERT", Id: "1", Data: `{}`},
+				{Table: "b", Action: "UPSERT", Id: "2", Data: `{}`},
+				{Table: "a", Action: "UPSERT", Id: "3", Data: `{}`},
+			},
+			order: []string{"b", "a"},
+			want:  map[string][]string{"a": {"3"}, "b": {"1", "2"}},
+		},
+		{
+			name: "table appearing again keeps input order",
+			batch: []MigrationData{
+				{Table: "a", Action: "UPSERT", Id: "1", Data: `{}`},
+				{Table: "b", Action: "UPSERT", Id: "2", Data: `{}`},
+				{Table: "a", Action: "DELETE", Id: "3"},
+			},
+			order: []string{"a", "b", "a"},
+			want:  map[string][]string{"a": {"1", "3"}, "b": {"2"}},
+		},
+		{
+			name: "parent first by parent field",
+			batch: []MigrationData{
+				{Table: "child", Action: "UPSERT", Id: "1", Parent: "p1", Data: `{}`},
+				{Table: "parent", Action: "UPSERT", Id: "p1", Data: `{}`},
+			},
+			parentFirst: true,
+			order:       []string{"parent", "child"},
+			want:        map[string][]string{"parent": {"p1"}, "child": {"1"}},
+		},
+		{
+			name: "parent first by parent path",
+			batch: []MigrationData{
+				{Table: "child", Action: "UPSERT", Id: "1", Data: `{"__parent": "p1"}`},
+				{Table: "other", Action: "DELETE", Id: "2"},
+				{Table: "parent", Action: "UPSERT", Id: "p1", Data: `{}`},
+			},
+			parentFirst: true,
+			order:       []string{"other", "parent", "child"},
+			want:        map[string][]string{"parent": {"p1"}, "child": {"1"}, "other": {"2"}},
+		},
+		{
+			name: "input order without parent first",
+			batch: []MigrationData{
+				{Table: "child", Action: "UPSERT", Id: "1", Parent: "p1", Data: `{}`},
+				{Table: "parent", Action: "UPSERT", Id: "p1", Data: `{}`},
+			},
+			order: []string{"child", "parent"},
+			want:  map[string][]string{"parent": {"p1"}, "child": {"1"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			m := Migration{batch: tt.batch, ParentFirst: tt.parentFirst}
+			order := []string{}
+			ids := map[string][]string{}
+			for _, group := range m.groupBatch() {
+				order = append(order, group.table)
+				for _, mData := range group.mDatas {
+					ids[group.table] = append(ids[group.table], mData.Id)
+				}
+			}
+
+			if !reflect.DeepEqual(order, tt.order) {
+				t.Errorf("order = %v, want %v", order, tt.order)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("ids = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddToBatchDedup(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		input []MigrationData
+		want  []string
+	}{
+		{
+			name: "last write wins",
+			input: []MigrationData{
+				{Table: "t", Action: "UPSERT", Id: "1", Data: `{"v": 1}`},
+				{Table: "t", Action: "UPSERT", Id: "2", Data: `{}`},
+				{Table: "t", Action: "DELETE", Id: "1"},
+			},
+			want: []string{"UPSERT 2", "DELETE 1"},
+		},
+		{
+			name: "same id in other table is kept",
+			input: []MigrationData{
+				{Table: "a", Action: "UPSERT", Id: "1", Data: `{}`},
+				{Table: "b", Action: "UPSERT", Id: "1", Data: `{}`},
+			},
+			want: []string{"UPSERT 1", "UPSERT 1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			m := Migration{Dedup: true}
+			for _, mData := range tt.input {
+				if err := m.addToBatch(mData); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := []string{}
+			for i, mData := range m.batch {
+				got = append(got, mData.Action+" "+mData.Id)
+				if m.batchIndex[batchKey(mData)] != i {
+					t.Errorf("batchIndex of %s = %d, want %d", mData.Id, m.batchIndex[batchKey(mData)], i)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("batch = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// pluginExample 對同一個 id 輸出 UPSERT 與 DELETE，未 dedup 時分成兩個批次，
+// 第二個批次讀到的原資料是第一個批次寫入的結果，不可再備份
+func TestBackupPluginExamplePair(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	id := utils.NewRunId(time.Now())
+	m := Migration{}
+	if m.oFile, err = os.Create(filepath.Join(dir, id+backup.OriginSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	defer m.oFile.Close()
+	if m.uFile, err = os.Create(filepath.Join(dir, id+backup.UpsertSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	defer m.uFile.Close()
+
+	origin := OriginData{Id: "c1", Data: `{"id": "c1"}`}
+	upserted := OriginData{Id: "c1", Data: `{"id": "c1", "updatedAt": "2017-12-25T00:00:00.000000+00:00"}`}
+	batches := []struct {
+		oDatas    []OriginData
+		changeIds []string
+	}{
+		{[]OriginData{origin}, []string{"c1"}},
+		{[]OriginData{upserted}, []string{"c1"}},
+		// 原本不存在的資料，第二次的原資料同樣是 migration 寫入的結果
+		{nil, []string{"c2"}},
+		{[]OriginData{{Id: "c2", Data: `{"id": "c2"}`}}, []string{"c2"}},
+	}
+	for _, b := range batches {
+		if err := m.writeToBackupFile("activitycouponcode", b.oDatas, b.changeIds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records := []backup.Record{}
+	err = backup.ReadRecords(dir, id, func(line int, r backup.Record, err error) error {
+		if err != nil {
+			t.Errorf("line %d: %v", line, err)
+		}
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 || records[0].Id != origin.Id || records[0].Data != origin.Data {
+		t.Errorf("records = %+v, want only the origin of c1", records)
+	}
+
+	// upsertID 仍記錄每個批次變動的 id
+	changes := 0
+	err = backup.ReadChanges(dir, id, func(line int, table string, ids []string) error {
+		changes += len(ids)
+		return nil
+	})
+	if err != nil || changes != len(batches) {
+		t.Errorf("changes = %d, %v, want %d", changes, err, len(batches))
+	}
+}
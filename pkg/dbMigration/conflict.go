@@ -0,0 +1,93 @@
+package dbMigration
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/meepshop/go-db-migration/pkg/backup"
+)
+
+// Conflict plugin 轉換期間原資料已被其他程式修改的資料，Current 為目前的資料，已刪除時為空字串
+type Conflict struct {
+	MigrationData
+	Current string `json:"current"`
+}
+
+// DataVersion 資料的版本，以 PG 輸出的 data 計算
+func DataVersion(data string) string {
+
+	sum := md5.Sum([]byte(data))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// checkVersions 過濾掉 version 與目前資料不同的資料，並記錄為衝突
+func (m *Migration) checkVersions(mDatas []MigrationData, originMap map[string]OriginData) []MigrationData {
+
+	applied := []MigrationData{}
+	for _, mData := range mDatas {
+
+		if mData.Version == "" {
+			applied = append(applied, mData)
+			continue
+		}
+
+		current := ""
+		oData, exists := originMap[mData.Id]
+		if exists {
+			current = DataVersion(oData.Data)
+		}
+		if current == mData.Version {
+			applied = append(applied, mData)
+			continue
+		}
+
+		m.batchLogger(mData.Table).Warn("version conflict", "id", mData.Id)
+		m.conflicts = append(m.conflicts, Conflict{MigrationData: mData, Current: oData.Data})
+	}
+
+	return applied
+}
+
+// reportConflicts 將衝突寫入 backup 下的 _conflicts 檔，每行一筆
+func (m *Migration) reportConflicts(conflicts []Conflict) error {
+
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	if m.cFile == nil {
+		f, err := os.OpenFile(m.backupPrefix+backup.ConflictsSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Printf("%+v", err)
+			return err
+		}
+		m.cFile = f
+	}
+
+	for _, c := range conflicts {
+		b, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		if _, err := m.cFile.Write(append(b, '\n')); err != nil {
+			log.Printf("Write conflicts error: %+v", err)
+			return err
+		}
+		m.stats.count(c.Table, "CONFLICT")
+	}
+
+	return nil
+}
+
+// takeConflicts 取出目前累積的衝突
+func (m *Migration) takeConflicts() []Conflict {
+
+	conflicts := m.conflicts
+	m.conflicts = nil
+
+	return conflicts
+}
@@ -0,0 +1,186 @@
+package dbMigration
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/meepshop/go-db-migration/pkg/lock"
+	"github.com/meepshop/go-db-migration/pkg/utils"
+)
+
+var errStopped = errors.New("migration stopped")
+
+// control 執行中的暫停、繼續與停止
+type control struct {
+	mu       sync.Mutex
+	paused   bool
+	resume   chan struct{}
+	stop     chan struct{}
+	stopping bool
+
+	// committing PG 已開始 commit，寫完ES前不可中斷，否則PG與ES不一致
+	committing bool
+}
+
+func newControl() *control {
+	return &control{resume: make(chan struct{}), stop: make(chan struct{})}
+}
+
+// wait 暫停時等待繼續，已要求停止時回傳 false
+func (c *control) wait() bool {
+
+	for {
+		c.mu.Lock()
+		paused, resume, stopping := c.paused, c.resume, c.stopping
+		c.mu.Unlock()
+
+		if stopping {
+			return false
+		}
+		if !paused {
+			return true
+		}
+
+		select {
+		case <-resume:
+		case <-c.stop:
+		}
+	}
+}
+
+func (c *control) togglePause() {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.paused = !c.paused
+	if c.paused {
+		log.Println("Migration paused, send SIGUSR1 again to resume")
+	} else {
+		log.Println("Migration resumed")
+		close(c.resume)
+		c.resume = make(chan struct{})
+	}
+}
+
+// requestStop 要求停止，已要求過時回傳 false
+func (c *control) requestStop() bool {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopping {
+		return false
+	}
+	c.stopping = true
+	close(c.stop)
+
+	return true
+}
+
+func (c *control) setCommitting(committing bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.committing = committing
+}
+
+// abort PG commit 前取消目前的批次，已 commit 時不取消並回傳 false
+func (c *control) abort(cancel func()) bool {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.committing {
+		return false
+	}
+	cancel()
+
+	return true
+}
+
+func (c *control) stopped() bool {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stopping
+}
+
+// HandleSignals SIGINT、SIGTERM 時停止讀取資料，寫完目前的批次後結束；再次收到時中斷並還原目前的批次，
+// PG 已 commit 時仍會寫完ES．
+// SIGUSR1 暫停或繼續執行
+func (m *Migration) HandleSignals() {
+
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+
+	go func() {
+		for sig := range ch {
+			if sig == syscall.SIGUSR1 {
+				m.ctl.togglePause()
+			} else if m.ctl.requestStop() {
+				log.Printf("Received %s, finishing the current batch. Send again to abort it\n", sig)
+			} else if m.ctl.abort(m.cancel) {
+				log.Printf("Received %s again, rolling back the current batch\n", sig)
+			} else {
+				log.Printf("Received %s again, PG is already committed, finishing the ES bulk of the current batch\n", sig)
+			}
+		}
+	}()
+}
+
+// ResumeToken 續跑用的代號，格式為 <備份時間>:<已寫入的輸入筆數>
+func (m *Migration) ResumeToken() string {
+	return fmt.Sprintf("%s:%d", m.runId, m.applied)
+}
+
+// logResume 未完成全部資料時輸出續跑方式
+func (m *Migration) logResume(err error) {
+
+	if err == nil {
+		return
+	}
+
+	log.Printf("Migration stopped after %d inputs. Resume with --resume=%s\n", m.applied, m.ResumeToken())
+}
+
+func parseResumeToken(token string) (string, int, error) {
+
+	parts := strings.Split(token, ":")
+	if len(parts) != 2 || !utils.IsRunId(parts[0]) {
+		return "", 0, errors.New("invalid resume token: " + token)
+	}
+
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n < 0 {
+		return "", 0, errors.New("invalid resume token: " + token)
+	}
+
+	return parts[0], n, nil
+}
+
+// startLock 依 Lock 取得專用連線，global 模式直接取得全域 lock
+func (m *Migration) startLock() error {
+
+	mode := m.Lock
+	if mode == "" {
+		mode = lock.ModeNone
+	}
+
+	locker, err := lock.New(m.ctx, m.db, mode, m.LockWait, m.runId)
+	if err != nil {
+		return err
+	}
+	m.locker = locker
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package dbMigration
+
+import (
+	"testing"
+)
+
+func TestParseResumeToken(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		token string
+		runId string
+		skip  int
+		err   bool
+	}{
+		{"run id", "01JAB3QK2H7M4X9R8T6V5W2Y1Z:1200", "01JAB3QK2H7M4X9R8T6V5W2Y1Z", 1200, false},
+		{"legacy run id", "20180321093000:0", "20180321093000", 0, false},
+		{"missing count", "01JAB3QK2H7M4X9R8T6V5W2Y1Z", "", 0, true},
+		{"negative count", "01JAB3QK2H7M4X9R8T6V5W2Y1Z:-1", "", 0, true},
+		{"invalid count", "01JAB3QK2H7M4X9R8T6V5W2Y1Z:abc", "", 0, true},
+		{"invalid run id", "01JAB3QK2H7M4X9R8T6V5W2Y1U:1", "", 0, true},
+		{"invalid time", "20181321093000:1", "", 0, true},
+		{"too many parts", "01JAB3QK2H7M4X9R8T6V5W2Y1Z:1:2", "", 0, true},
+		{"path", "../backup:1", "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			runId, skip, err := parseResumeToken(tt.token)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parseResumeToken(%s) expected error", tt.token)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if runId != tt.runId || skip != tt.skip {
+				t.Errorf("parseResumeToken(%s) = %s, %d, want %s, %d", tt.token, runId, skip, tt.runId, tt.skip)
+			}
+		})
+	}
+}
+
+func TestControlAbort(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		committing bool
+		want       bool
+	}{
+		{"before commit", false, true},
+		{"after commit", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			c := newControl()
+			c.setCommitting(tt.committing)
+
+			cancelled := false
+			if got := c.abort(func() { cancelled = true }); got != tt.want || cancelled != tt.want {
+				t.Errorf("abort = %v, cancelled = %v, want %v", got, cancelled, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package dbMigration
+
+// EsDocHook 依 table 轉換寫入ES的文件，傳入的 EsData 為 plugin 提供的 esData 或 data
+type EsDocHook func(mData MigrationData) (string, error)
+
+var esDocHooks = map[string]EsDocHook{}
+
+// RegisterEsDocHook 註冊 table 的ES文件轉換
+func RegisterEsDocHook(table string, hook EsDocHook) {
+	esDocHooks[table] = hook
+}
+
+// esDoc 取得寫入ES的文件，未提供 esData 時與PG相同
+func esDoc(mData MigrationData) (string, error) {
+
+	if mData.EsData == "" {
+		mData.EsData = mData.Data
+	}
+
+	if hook, ok := esDocHooks[mData.Table]; ok {
+		return hook(mData)
+	}
+
+	return mData.EsData, nil
+}
@@ -0,0 +1,49 @@
+package dbMigration
+
+import (
+	"time"
+
+	"github.com/meepshop/go-db-migration/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var (
+	recordsTotal = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "migration_records_total",
+		Help: "Records processed by table and action.",
+	}, []string{"table", "action"})
+	batchSize = metrics.Factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "migration_batch_size",
+		Help:    "Records per batch.",
+		Buckets: []float64{1, 5, 10, 25, 50, 100, 200},
+	})
+	pgSeconds = metrics.Factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "migration_pg_statement_seconds",
+		Help:    "PG statement latency by statement.",
+		Buckets: latencyBuckets,
+	}, []string{"statement"})
+	esBulkSeconds = metrics.Factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "migration_es_bulk_seconds",
+		Help:    "ES bulk request latency.",
+		Buckets: latencyBuckets,
+	})
+	esBulkFailures = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "migration_es_bulk_item_failures_total",
+		Help: "ES bulk item failures by error type.",
+	}, []string{"type"})
+	backupBytes = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Name: "migration_backup_bytes_total",
+		Help: "Bytes written to backup files.",
+	})
+	pluginQueueDepth = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Name: "migration_plugin_queue_depth",
+		Help: "Rows waiting for or being transformed.",
+	})
+)
+
+// observePg 記錄PG語法的耗時
+func observePg(statement string, start time.Time) {
+	pgSeconds.WithLabelValues(statement).Observe(time.Since(start).Seconds())
+}
@@ -2,23 +2,33 @@ package dbMigration
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/meepshop/go-db-migration/pkg/backup"
 	"github.com/meepshop/go-db-migration/pkg/database"
+	"github.com/meepshop/go-db-migration/pkg/lock"
+	"github.com/meepshop/go-db-migration/pkg/logger"
+	"github.com/meepshop/go-db-migration/pkg/throttle"
 	"github.com/meepshop/go-db-migration/pkg/utils"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	elastic "gopkg.in/olivere/elastic.v5"
 )
 
-func QueryDataAndOutput(query string) error {
+// QueryDataAndOutput 輸出 query 撈出的 data，envelope 為 true 時每行輸出 {"id", "version", "data"}，
+// plugin 需將 version 原樣放入轉換結果
+func QueryDataAndOutput(query string, envelope bool) error {
 
 	pg, err := database.NewPGConn()
 	if err != nil {
@@ -26,7 +36,33 @@ func QueryDataAndOutput(query string) error {
 	}
 	defer pg.Close()
 
-	rows, err := pg.Query(query)
+	return QueryRows(pg, query, func(row Row) error {
+		if !envelope {
+			fmt.Println(row.Data)
+			return nil
+		}
+
+		b, err := json.Marshal(map[string]interface{}{"id": row.Id, "version": row.Version, "data": json.RawMessage(row.Data)})
+		if err != nil {
+			log.Printf("Envelope marshal error ID: %s. %+v\n", row.Id, err)
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	})
+}
+
+// Row query 撈出的一筆資料，Version 為 data 的版本
+type Row struct {
+	Id      string
+	Data    string
+	Version string
+}
+
+// QueryRows 執行 query 並逐筆交給 fn 處理，query 需撈出 id, data 兩個欄位
+func QueryRows(db *sql.DB, query string, fn func(row Row) error) error {
+
+	rows, err := db.Query(query)
 	if err != nil {
 		log.Println(err)
 		return err
@@ -41,41 +77,131 @@ func QueryDataAndOutput(query string) error {
 			return err
 		}
 
-		fmt.Println(data)
+		if err := fn(Row{Id: id, Data: data, Version: DataVersion(data)}); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return rows.Err()
 }
 
+// ES 拒絕寫入時的重試次數
+const bulkRetries = 5
+
 type Migration struct {
 	db       *sql.DB
 	es       *elastic.Client
 	oFile    *os.File
 	uFile    *os.File
+	pFile    *os.File
+	cFile    *os.File
 	execTime int64
+
+	// runId ULID 格式的執行識別，用於備份檔名、log 及 migration_runs
+	runId        string
+	backupPrefix string
+
+	// ctx 寫入PG、ES使用，強制停止時取消
+	ctx    context.Context
+	cancel context.CancelFunc
+	ctl    *control
+
+	// done 已放入批次的輸入筆數，applied 已寫入的輸入筆數，skip 續跑時略過的筆數
+	done    int
+	applied int
+	skip    int
+
+	// Workers ProcTransform 同時轉換的數量
+	Workers int
+	// SkipErrors ProcTransform 轉換失敗時略過該筆資料，不中斷執行
+	SkipErrors bool
+	// Dedup 同一批次內重複的 (table, id) 只保留最後一筆
+	Dedup bool
+	// ParentFirst 有 parent 的 table 在其他 table 之後寫入，供ES parent/child 使用
+	ParentFirst bool
+	// CheckVersion ProcTransform 將 query 的 version 帶入同 id 的資料，只在原資料未變動時寫入
+	CheckVersion bool
+	// ConflictRetries ProcTransform 遇到衝突時以目前資料重新轉換的次數，超過後回報
+	ConflictRetries int
+	// Throttle 寫入速度限制，nil 時不限制
+	Throttle *throttle.Throttle
+	// Progress 輸出進度的間隔，0 時不輸出
+	Progress time.Duration
+	// Lock advisory lock 的範圍：table、global 或 none，空值同 none
+	Lock string
+	// LockWait lock 被其他執行持有時最長的等待時間，0 時直接失敗
+	LockWait time.Duration
+
+	// 記錄於 migration_runs 的來源 query 與 plugin，ProcTransform 會以傳入的 query 為準
+	SourceQuery string
+	Plugin      string
+	PluginHash  string
+
+	batch      []MigrationData
+	batchIndex map[string]int
+	batchNo    int
+	conflicts  []Conflict
+	stats      *runStats
+	previous   *Stats
+	locker     *lock.Locker
+
+	// backedUp 這次執行已備份的 (table, id)，同一筆資料只保留第一次變動前的原資料
+	backedUp map[string]bool
+
+	// 寫入前檢查用的快取
+	tables  map[string]bool
+	schemas map[string]*jsonschema.Schema
 }
 
 type MigrationData struct {
-	Table  string
-	Action string
-	Id     string
-	Data   string
-	Parent string
+	Table   string                 `json:"table"`
+	Action  string                 `json:"action"`
+	Id      string                 `json:"id"`
+	Data    string                 `json:"data"`
+	Parent  string                 `json:"parent"`
+	Columns map[string]interface{} `json:"columns,omitempty"`
+	EsData  string                 `json:"esData,omitempty"`
+
+	// UPDATE 使用，Doc 為部分更新的json，或以 Script 更新ES並以 PgUpdate 更新PG
+	Doc      string    `json:"doc,omitempty"`
+	Script   *EsScript `json:"script,omitempty"`
+	PgUpdate string    `json:"pgUpdate,omitempty"`
+
+	// Version query 時的資料版本，有值時只在原資料未變動時寫入
+	Version string `json:"version,omitempty"`
+}
+
+// EsScript ES scripted update，PG 需搭配 PgUpdate 提供對應的 SQL
+type EsScript struct {
+	Source string                 `json:"source"`
+	Lang   string                 `json:"lang,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty"`
 }
 
 type OriginData struct {
-	Id     string
-	Data   string
-	Parent string
+	Id      string
+	Data    string
+	Parent  string
+	Columns string
+	EsData  string
 }
 
 func NewMigration() (Migration, error) {
+	return newMigration("")
+}
 
-	m := Migration{}
+// ResumeMigration 由停止時輸出的 token 續跑，略過已寫入的輸入並附加至原本的備份檔
+func ResumeMigration(token string) (Migration, error) {
+	return newMigration(token)
+}
+
+func newMigration(token string) (Migration, error) {
+
+	m := Migration{ctl: newControl(), stats: newRunStats()}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
 
 	localLocation, _ := time.LoadLocation("UTC")
 	execTime := time.Now().In(localLocation)
-	m.execTime = execTime.UnixNano()
 
 	pg, err := database.NewPGConn()
 	if err != nil {
@@ -89,162 +215,783 @@ func NewMigration() (Migration, error) {
 	}
 	m.es = es
 
-	timeString := execTime.Format("20060102150405")
-	log.Println(timeString)
-	originFile, err := os.Create("backup/" + timeString + "_originData")
+	if err := utils.LoadTableConfig(os.Getenv("TABLE_CONFIG")); err != nil {
+		return m, err
+	}
+	if err := utils.ValidateTableConfig(m.db, m.es); err != nil {
+		return m, err
+	}
+
+	runId := utils.NewRunId(execTime)
+	m.execTime = utils.RunIdVersion(runId)
+
+	// 備份檔已存在時不覆寫，直接失敗
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if token != "" {
+		// 續跑時 ES version 仍使用目前時間，備份附加至原本的檔案
+		skip := 0
+		if runId, skip, err = parseResumeToken(token); err != nil {
+			return m, err
+		}
+		m.skip, m.done, m.applied = skip, skip, skip
+		flag = os.O_WRONLY | os.O_APPEND
+	}
+	logger.SetRunID(runId)
+	log.Println(runId)
+	m.runId = runId
+	m.backupPrefix = filepath.Join(backup.Dir, runId)
+	originFile, err := os.OpenFile(m.backupPrefix+backup.OriginSuffix, flag, 0644)
 	if err != nil {
 		log.Printf("%+v", err)
 		return m, err
 	}
 	m.oFile = originFile
 
-	upsertFile, err := os.Create("backup/" + timeString + "_upsertID")
+	upsertFile, err := os.OpenFile(m.backupPrefix+backup.UpsertSuffix, flag, 0644)
 	if err != nil {
 		log.Printf("%+v", err)
 		return m, err
 	}
 	m.uFile = upsertFile
 
+	// 舊版的備份沒有 postHash，續跑時另外建立
+	if token != "" {
+		flag |= os.O_CREATE
+	}
+	postFile, err := os.OpenFile(m.backupPrefix+backup.PostSuffix, flag, 0644)
+	if err != nil {
+		log.Printf("%+v", err)
+		return m, err
+	}
+	m.pFile = postFile
+
+	if token != "" {
+		m.loadPrevious()
+		if err := m.loadBackedUp(); err != nil {
+			return m, err
+		}
+	}
+
 	return m, nil
 }
 
-func (m *Migration) ProcDbBigration() error {
+func (m *Migration) ProcDbBigration() (err error) {
 
-	scanner := bufio.NewScanner(os.Stdin)
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, "reading standard input:", err)
+	if err := m.startHistory("consumer", m.SourceQuery); err != nil {
+		return err
 	}
+	defer func() { m.finish(err) }()
+	if err := m.startLock(); err != nil {
+		return err
+	}
+	defer m.startProgress()()
 
-	count := 0
-	batchBuffer := map[string][]MigrationData{}
-	for scanner.Scan() {
+	// 另外讀取 避免等待輸入時無法停止
+	lines := make(chan []byte)
+	go func() {
+		defer close(lines)
+
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			select {
+			case lines <- append([]byte(nil), scanner.Bytes()...):
+			case <-m.ctl.stop:
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintln(os.Stderr, "reading standard input:", err)
+		}
+	}()
+
+	read := 0
+	for m.ctl.wait() {
+
+		var line []byte
+		var ok bool
+		select {
+		case line, ok = <-lines:
+		case <-m.ctl.stop:
+		}
+		if !ok {
+			break
+		}
+
+		// 續跑時略過已寫入的輸入
+		if read += 1; read <= m.skip {
+			continue
+		}
+		m.stats.addInput(false)
 
 		var mDatas []MigrationData
-		err := json.Unmarshal(scanner.Bytes(), &mDatas)
+		err := json.Unmarshal(line, &mDatas)
 		if err != nil {
-			log.Printf("Exec migration unmarshal error. Data: %s.\n", scanner.Text())
+			logger.L().Error("exec migration unmarshal error", "line", read, "data", string(line), "err", err)
 			return err
 		}
 
-		for _, mData := range mDatas {
-			count += 1
-			batchBuffer[mData.Table] = append(batchBuffer[mData.Table], mData)
+		if err := m.addRecords(mDatas); err != nil {
+			return err
 		}
+		m.done += 1
 
-		// 累積達到一定數量 批次進行資料更新
-		if count >= 100 {
-			err = m.dataUpdateAndBackup(batchBuffer)
-			if err != nil {
+		// 外部 plugin 無法重新轉換 衝突直接回報
+		if err := m.reportConflicts(m.takeConflicts()); err != nil {
+			return err
+		}
+	}
+
+	if err := m.flush(); err != nil {
+		return err
+	}
+
+	if err := m.reportConflicts(m.takeConflicts()); err != nil {
+		return err
+	}
+
+	if m.ctl.stopped() {
+		return errStopped
+	}
+
+	return nil
+}
+
+// ProcTransform 直接以 transform 轉換 query 撈出的資料，不需經過外部 plugin，
+// Workers 大於 1 時會同時轉換多筆資料，寫入順序仍與 query 相同
+func (m *Migration) ProcTransform(ctx context.Context, query string, transform func(ctx context.Context, row Row) ([]MigrationData, error)) (err error) {
+
+	if err := m.startHistory("run", query); err != nil {
+		return err
+	}
+	defer func() { m.finish(err) }()
+	if err := m.startLock(); err != nil {
+		return err
+	}
+	defer m.startProgress()()
+
+	workers := m.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pending := make(chan chan transformResult, workers)
+	queryErr := make(chan error, 1)
+	go func() {
+		defer close(pending)
+		read := 0
+		queryErr <- QueryRows(m.db, query, func(row Row) error {
+			// 續跑時略過已寫入的資料 query 需有固定的排序
+			if read += 1; read <= m.skip {
+				return nil
+			}
+
+			ch := make(chan transformResult, 1)
+			select {
+			case pending <- ch:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			pluginQueueDepth.Add(1)
+			go func() {
+				mDatas, err := transform(ctx, row)
+				ch <- transformResult{row: row, mDatas: mDatas, err: err}
+			}()
+			return nil
+		})
+	}()
+
+	attempts := map[string]int{}
+
+	var procErr error
+	stopped := false
+	for ch := range pending {
+		res := <-ch
+		pluginQueueDepth.Add(-1)
+		if procErr != nil || stopped {
+			continue
+		}
+		if stopped = !m.ctl.wait(); stopped {
+			cancel()
+			continue
+		}
+
+		if res.err != nil && m.SkipErrors {
+			logger.L().Warn("transform error, skipped", "id", res.row.Id, "err", res.err)
+			m.stats.addInput(true)
+			m.done += 1
+			continue
+		} else if res.err != nil {
+			logger.L().Error("transform error", "id", res.row.Id, "err", res.err)
+			m.stats.addInput(true)
+			procErr = res.err
+		} else {
+			m.stats.addInput(false)
+			if procErr = m.addRecords(m.withVersion(res.row, res.mDatas)); procErr == nil {
+				m.done += 1
+			}
+		}
+		if procErr == nil {
+			procErr = m.retryConflicts(ctx, transform, attempts)
+		}
+		if procErr != nil {
+			cancel()
+		}
+	}
+
+	if err := <-queryErr; procErr == nil && !stopped {
+		procErr = err
+	}
+	if procErr != nil {
+		return procErr
+	}
+
+	for {
+		if err := m.flush(); err != nil {
+			return err
+		}
+		// 停止時不再重新轉換
+		if stopped {
+			if err := m.reportConflicts(m.takeConflicts()); err != nil {
+				return err
+			}
+		}
+		if len(m.conflicts) == 0 {
+			if stopped {
+				return errStopped
+			}
+			return nil
+		}
+		if err := m.retryConflicts(ctx, transform, attempts); err != nil {
+			return err
+		}
+	}
+}
+
+// withVersion CheckVersion 時將 query 的 version 帶入與 row 同 id 的資料
+func (m *Migration) withVersion(row Row, mDatas []MigrationData) []MigrationData {
+
+	if !m.CheckVersion {
+		return mDatas
+	}
+
+	for i := range mDatas {
+		if mDatas[i].Id == row.Id && mDatas[i].Version == "" {
+			mDatas[i].Version = row.Version
+		}
+	}
+
+	return mDatas
+}
+
+// retryConflicts 以目前的資料重新轉換衝突的資料並帶入新的 version，超過 ConflictRetries 或資料已刪除時回報
+func (m *Migration) retryConflicts(ctx context.Context, transform func(ctx context.Context, row Row) ([]MigrationData, error), attempts map[string]int) error {
+
+	for _, c := range m.takeConflicts() {
+
+		key := batchKey(c.MigrationData)
+		if c.Current == "" || attempts[key] >= m.ConflictRetries {
+			if err := m.reportConflicts([]Conflict{c}); err != nil {
 				return err
 			}
+			continue
+		}
+		attempts[key] += 1
 
-			count = 0
-			batchBuffer = map[string][]MigrationData{}
+		row := Row{Id: c.Id, Data: c.Current, Version: DataVersion(c.Current)}
+		mDatas, err := transform(ctx, row)
+		if err != nil {
+			logger.L().Error("transform error", "id", row.Id, "err", err)
+			return err
+		}
+		for i := range mDatas {
+			if mDatas[i].Id == row.Id {
+				mDatas[i].Version = row.Version
+			}
+		}
+		if err := m.addRecords(mDatas); err != nil {
+			return err
 		}
 	}
 
-	if len(batchBuffer) > 0 {
-		if err := m.dataUpdateAndBackup(batchBuffer); err != nil {
+	return nil
+}
+
+type transformResult struct {
+	row    Row
+	mDatas []MigrationData
+	err    error
+}
+
+// addRecords 累積資料 達到一定數量 批次進行資料更新
+func (m *Migration) addRecords(mDatas []MigrationData) error {
+
+	// 全部檢查通過才放入批次，避免寫到一半才被PG拒絕
+	for _, mData := range mDatas {
+		if err := m.validate(mData); err != nil {
+			logger.L().Error("invalid migration data", "table", mData.Table, "id", mData.Id, "err", err)
+			return err
+		}
+	}
+
+	m.Throttle.WaitRecords(len(mDatas))
+
+	for _, mData := range mDatas {
+		if err := m.addToBatch(mData); err != nil {
 			return err
 		}
 	}
 
+	if len(m.batch) >= 100 {
+		return m.flush()
+	}
+
 	return nil
 }
 
-func (m *Migration) dataUpdateAndBackup(batchBuffer map[string][]MigrationData) error {
+func (m *Migration) flush() error {
 
-	ctx := context.Background()
+	if len(m.batch) == 0 {
+		return nil
+	}
+
+	m.Throttle.WaitBatch()
+
+	m.batchNo += 1
+	batchSize.Observe(float64(len(m.batch)))
+	if err := m.dataUpdateAndBackup(m.groupBatch()); err != nil {
+		return err
+	}
+	m.applied = m.done
 
-	for table, mDatas := range batchBuffer {
+	m.batch = nil
+	m.batchIndex = map[string]int{}
 
-		esTable := utils.PgEsTableMapping[table]
-		if esTable == "" {
-			esTable = table
+	return nil
+}
+
+func (m *Migration) dataUpdateAndBackup(groups []tableBatch) error {
+
+	for _, group := range groups {
+		if err := m.updateTable(group.table, group.mDatas); err != nil {
+			return err
 		}
+	}
 
-		var values []string
-		bulk := m.es.Bulk().Index(os.Getenv("ELASTIC_DB")).Type(esTable)
+	return nil
+}
 
-		oDatas := []OriginData{}
-		changeIds := []string{}
+// updateTable 更新一個 table 的資料，PG 的變動在同一個 transaction 內，
+// 帶有 version 的資料會先鎖定原資料，與 query 時不同則視為衝突不寫入
+func (m *Migration) updateTable(table string, mDatas []MigrationData) error {
 
-		for _, mData := range mDatas {
+	ctx := m.ctx
+	lg := m.batchLogger(table)
+
+	// 第一次寫入 table 前取得其 lock，validate 只檢查資料不取得 lock
+	if err := m.locker.Table(ctx, table); err != nil {
+		lg.Error("PG lock error", "err", err)
+		return err
+	}
 
-			changeIds = append(changeIds, mData.Id)
+	tc := utils.GetTableConfig(table)
 
-			if mData.Action == "DELETE" {
-				bulk.Add(elastic.NewBulkDeleteRequest().Id(mData.Id))
-			} else if mData.Action == "UPSERT" {
-				// escape '
-				ecmData := strings.Replace(mData.Data, "'", "''", -1)
-				values = append(values, fmt.Sprintf("('%s', '%s')", mData.Id, ecmData))
-				bulk.Add(elastic.NewBulkIndexRequest().Id(mData.Id).VersionType("external").Version(m.execTime).Parent(mData.Parent).Doc(mData.Data))
-			}
+	var values []string
+	var updates []pgUpdate
+	reqs := []elastic.BulkableRequest{}
+
+	oDatas := []OriginData{}
+	originMap := map[string]OriginData{}
+	queryIds := []string{}
+	changeIds := []string{}
+	deleteIds := []string{}
+
+	lock := ""
+	for _, mData := range mDatas {
+		queryIds = append(queryIds, mData.Id)
+		if mData.Version != "" {
+			lock = " FOR UPDATE"
 		}
+	}
 
-		// 備份所有有變動的資料
-		oQuery := `SELECT id, CASE WHEN data->>'__parent' IS NOT NULL THEN data->>'__parent' ELSE '' END, data FROM %s WHERE id IN ('%s')`
-		rows, err := m.db.Query(fmt.Sprintf(oQuery, table, strings.Join(changeIds, "','")))
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		lg.Error("PG begin error", "err", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	// 備份所有有變動的資料
+	oQuery := `SELECT %s, %s, %s, %s FROM %s WHERE %s IN ('%s')%s`
+	start := time.Now()
+	rows, err := tx.Query(fmt.Sprintf(oQuery, tc.IdIdent(), tc.ParentExpr(), tc.DataIdent(), tc.ColumnsExpr(), table, tc.IdIdent(), strings.Join(queryIds, "','"), lock))
+	observePg("select", start)
+	if err != nil {
+		lg.Error("PG error", "err", err)
+		return err
+	}
+
+	for rows.Next() {
+		var id, parent, data, columns string
+		err = rows.Scan(&id, &parent, &data, &columns)
 		if err != nil {
-			log.Printf("PG error: %+v", err)
+			rows.Close()
+			lg.Error("db scan error", "id", id, "err", err)
 			return err
 		}
 
-		for rows.Next() {
-			var id, parent, data string
-			err = rows.Scan(&id, &parent, &data)
+		originMap[id] = OriginData{Id: id, Parent: parent, Data: data, Columns: columns}
+	}
+	rows.Close()
+
+	// 原資料已被其他程式修改的資料 不寫入
+	mDatas = m.checkVersions(mDatas, originMap)
+
+	// 備份ES上的原文件
+	if tc.Synced() {
+		for _, mData := range mDatas {
+			if oData, ok := originMap[mData.Id]; ok {
+				oDatas = append(oDatas, oData)
+			}
+		}
+		if err := m.fetchEsDocs(ctx, tc, oDatas); err != nil {
+			return err
+		}
+		for _, oData := range oDatas {
+			originMap[oData.Id] = oData
+		}
+		oDatas = []OriginData{}
+	}
+
+	// 與原資料相同 不需寫入
+	mDatas = m.skipUnchanged(tc, mDatas, originMap)
+	if len(mDatas) == 0 {
+		return nil
+	}
+
+	for _, mData := range mDatas {
+		changeIds = append(changeIds, mData.Id)
+		if mData.Action != "UPDATE" {
+			deleteIds = append(deleteIds, mData.Id)
+		}
+		if oData, ok := originMap[mData.Id]; ok {
+			oDatas = append(oDatas, oData)
+		}
+	}
+
+	for _, mData := range mDatas {
+
+		if mData.Action == "DELETE" {
+			oData := originMap[mData.Id]
+			reqs = append(reqs, elastic.NewBulkDeleteRequest().Id(mData.Id).Parent(oData.Parent).Routing(tc.Routing(oData.Data)))
+		} else if mData.Action == "UPSERT" {
+			parent := mData.Parent
+			if parent == "" {
+				parent = tc.Parent(mData.Data)
+			}
+
+			doc, err := esDoc(mData)
 			if err != nil {
-				log.Printf("Db Scan error Table: %s ID: %s DATA: %s\n", table, id, data)
+				lg.Error("ES doc hook error", "id", mData.Id, "err", err)
 				return err
 			}
 
-			oDatas = append(oDatas, OriginData{Id: id, Parent: parent, Data: data})
+			values = append(values, tc.InsertValues(mData.Id, mData.Data, mData.Columns))
+			// 同一次執行的 version 固定，重複的 id 第二次寫入時 version 相同，external 會視為衝突
+			reqs = append(reqs, elastic.NewBulkIndexRequest().Id(mData.Id).VersionType("external_gte").Version(m.execTime).Parent(parent).Routing(tc.Routing(mData.Data)).Doc(doc))
+		} else if mData.Action == "UPDATE" {
+			oData, ok := originMap[mData.Id]
+			if !ok {
+				lg.Error("update target not found", "id", mData.Id)
+				return errors.New("update target not found")
+			}
+
+			update, req, err := updateRequest(tc, mData, oData, m.execTime)
+			if err != nil {
+				return err
+			}
+			updates = append(updates, update)
+			reqs = append(reqs, req)
 		}
+	}
 
-		// 將原有資料寫入備份檔案
-		m.writeToBackupFile(table, oDatas, changeIds)
+	// 將原有資料寫入備份檔案，備份失敗時不寫入任何資料
+	if err := m.writeToBackupFile(table, oDatas, changeIds); err != nil {
+		lg.Error("backup write error", "err", err)
+		return err
+	}
 
-		// PG DELETE
-		delSql := fmt.Sprintf("DELETE FROM %s WHERE id IN ('%s')", table, strings.Join(changeIds, "','"))
-		if _, err := m.db.Exec(delSql); err != nil {
-			log.Printf("PG delete error: %+v", err)
+	// PG DELETE
+	if len(deleteIds) > 0 {
+		delSql := fmt.Sprintf("DELETE FROM %s WHERE %s IN ('%s')", table, tc.IdIdent(), strings.Join(deleteIds, "','"))
+		start := time.Now()
+		_, err := tx.Exec(delSql)
+		observePg("delete", start)
+		if err != nil {
+			lg.Error("PG delete error", "err", err)
 			return err
 		}
+	}
 
-		// PG UPSERT
-		if len(values) > 0 {
-			// upsSql := fmt.Sprintf("INSERT INTO %s (id, data) VALUES %s ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data", table, strings.Join(values, ","))
-			upsSql := fmt.Sprintf("INSERT INTO %s (id, data) VALUES %s", table, strings.Join(values, ","))
-			if _, err := m.db.Exec(upsSql); err != nil {
-				log.Printf("PG insert error: %+v", err)
-				return err
-			}
+	// PG UPDATE
+	for _, update := range updates {
+		start := time.Now()
+		err := update.exec(tx, tc)
+		observePg("update", start)
+		if err != nil {
+			lg.Error("PG update error", "id", update.id, "err", err)
+			return err
+		}
+	}
+
+	// PG UPSERT
+	if len(values) > 0 {
+		upsSql := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", table, tc.InsertColumns(), strings.Join(values, ","))
+		start := time.Now()
+		_, err := tx.Exec(upsSql)
+		observePg("insert", start)
+		if err != nil {
+			lg.Error("PG insert error", "err", err)
+			return err
 		}
+	}
+
+	// 記錄寫入後的資料，還原時用來判斷之後是否又被修改
+	if err := m.writePostHashes(tx, tc, table, changeIds); err != nil {
+		lg.Error("PG post hash error", "err", err)
+		return err
+	}
+
+	// commit 後不再因停止訊號中斷，寫完ES才結束
+	m.ctl.setCommitting(true)
+	defer m.ctl.setCommitting(false)
+
+	start = time.Now()
+	err = tx.Commit()
+	observePg("commit", start)
+	if err != nil {
+		lg.Error("PG commit error", "err", err)
+		return err
+	}
+
+	// 不需同步ES的table 略過
+	if !tc.Synced() || len(reqs) == 0 {
+		m.countApplied(mDatas)
+		return nil
+	}
+
+	if err := m.doBulk(ctx, tc, reqs); err != nil {
+		return err
+	}
+
+	m.countApplied(mDatas)
 
-		// ES Bulk Do
-		res, err := bulk.Do(ctx)
+	return nil
+}
+
+// batchLogger 帶有 table 與批次編號的 logger
+func (m *Migration) batchLogger(table string) *slog.Logger {
+	return logger.L().With("table", table, "batch", m.batchNo)
+}
+
+// doBulk 執行ES bulk，被ES拒絕（429）的項目降速後重試
+func (m *Migration) doBulk(ctx context.Context, tc utils.TableConfig, reqs []elastic.BulkableRequest) error {
+
+	lg := m.batchLogger(tc.Table)
+
+	for attempt := 0; ; attempt++ {
+
+		start := time.Now()
+		res, err := m.es.Bulk().Index(tc.EsIndex).Type(tc.EsType).Add(reqs...).Do(ctx)
+		esBulkSeconds.Observe(time.Since(start).Seconds())
+		if elastic.IsStatusCode(err, http.StatusTooManyRequests) && attempt < bulkRetries {
+			time.Sleep(m.Throttle.Backoff())
+			continue
+		}
 		if err != nil {
-			log.Printf("ES bulk.Do error: %+v", err)
+			lg.Error("ES bulk.Do error", "err", err)
 			return errors.New("Bulk error")
 		}
-		if res.Errors {
-			for _, item := range res.Failed() {
-				log.Printf("type: %s, Id: %s", item.Type, item.Id)
-				log.Printf("reason type: %s, reason: %s", item.Error.Type, item.Error.Reason)
-				return errors.New("Bulk error")
+		m.Throttle.ObserveBulk(time.Since(start))
+
+		if !res.Errors {
+			return nil
+		}
+
+		// 回應的項目與請求順序相同
+		rejected := []elastic.BulkableRequest{}
+		for i, items := range res.Items {
+			for _, item := range items {
+				if item.Error != nil {
+					esBulkFailures.WithLabelValues(item.Error.Type).Inc()
+				}
+				if item.Status == http.StatusTooManyRequests && attempt < bulkRetries {
+					rejected = append(rejected, reqs[i])
+				} else if item.Status < 200 || item.Status > 299 {
+					reason := ""
+					if item.Error != nil {
+						reason = item.Error.Type + ": " + item.Error.Reason
+					}
+					lg.Error("ES bulk item error", "id", item.Id, "type", item.Type, "status", item.Status, "reason", reason)
+					return errors.New("Bulk error")
+				}
 			}
 		}
+
+		lg.Warn("ES rejected bulk items, retrying", "rejected", len(rejected), "items", len(reqs))
+		time.Sleep(m.Throttle.Backoff())
+		reqs = rejected
+	}
+}
+
+// pgUpdate 一筆資料的PG UPDATE；script 更新時新的 data 由PG計算，derive 代表需取回 data 重新計算額外欄位
+type pgUpdate struct {
+	id      string
+	sql     string
+	columns map[string]interface{}
+	derive  bool
+}
+
+// exec 執行 UPDATE，沒有更新到資料時回傳錯誤
+func (u pgUpdate) exec(tx *sql.Tx, tc utils.TableConfig) error {
+
+	if !u.derive {
+		res, err := tx.Exec(u.sql)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("update target not found: %s", u.id)
+		}
+		return nil
+	}
+
+	var data string
+	err := tx.QueryRow(u.sql + " RETURNING " + tc.DataIdent()).Scan(&data)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("update target not found: %s", u.id)
+	} else if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET %s WHERE %s = %s", tc.Table, strings.Join(tc.UpdateSets(data, u.columns), ", "), tc.IdIdent(), utils.SqlLiteral(u.id)))
+
+	return err
+}
+
+// updateRequest 組出 UPDATE 的PG語法與ES請求，額外欄位未提供時依新的 data 重新取值；
+// doc 更新時合併後的 data 與 UPSERT 相同經過 esData 及 EsDocHook 後寫入ES，script 更新則交由ES執行
+func updateRequest(tc utils.TableConfig, mData MigrationData, oData OriginData, version int64) (pgUpdate, elastic.BulkableRequest, error) {
+
+	update := pgUpdate{id: mData.Id, columns: mData.Columns}
+	if (mData.Doc == "") == (mData.Script == nil) {
+		logger.L().Error("update requires either doc or script", "table", tc.Table, "id", mData.Id)
+		return update, nil, errors.New("invalid update")
+	}
+
+	var req elastic.BulkableRequest
+	var dataExpr, data string
+	if mData.Doc != "" {
+		// PG 與ES相同 以原資料遞迴合併
+		merged, err := utils.MergeJson(oData.Data, mData.Doc)
+		if err != nil {
+			logger.L().Error("update doc merge error", "table", tc.Table, "id", mData.Id, "err", err)
+			return update, nil, err
+		}
+		data = merged
+		dataExpr = utils.SqlLiteral(merged)
+
+		full := mData
+		full.Data = merged
+		doc, err := esDoc(full)
+		if err != nil {
+			logger.L().Error("ES doc hook error", "table", tc.Table, "id", mData.Id, "err", err)
+			return update, nil, err
+		}
+		parent := mData.Parent
+		if parent == "" {
+			parent = tc.Parent(merged)
+		}
+		req = elastic.NewBulkIndexRequest().Id(mData.Id).VersionType("external_gte").Version(version).Parent(parent).Routing(tc.Routing(merged)).Doc(doc)
+	} else {
+		if mData.PgUpdate == "" {
+			logger.L().Error("update script requires pgUpdate", "table", tc.Table, "id", mData.Id)
+			return update, nil, errors.New("invalid update")
+		}
+		dataExpr = mData.PgUpdate
+		update.derive = tc.Derived(mData.Columns)
+		req = elastic.NewBulkUpdateRequest().Id(mData.Id).Parent(oData.Parent).Routing(tc.Routing(oData.Data)).
+			Script(elastic.NewScriptInline(mData.Script.Source).Lang(mData.Script.Lang).Params(mData.Script.Params))
+	}
+
+	// script 更新時 data 為空，只設定 columns，其餘待取回 data 後設定
+	sets := append([]string{fmt.Sprintf("%s = %s", tc.DataIdent(), dataExpr)}, tc.UpdateSets(data, mData.Columns)...)
+
+	update.sql = fmt.Sprintf("UPDATE %s SET %s WHERE %s = %s", tc.Table, strings.Join(sets, ", "), tc.IdIdent(), utils.SqlLiteral(mData.Id))
+	return update, req, nil
+}
+
+// fetchEsDocs 取得原資料在ES上的文件，不存在時 EsData 為空字串
+func (m *Migration) fetchEsDocs(ctx context.Context, tc utils.TableConfig, oDatas []OriginData) error {
+
+	if len(oDatas) == 0 {
+		return nil
+	}
+
+	mget := m.es.MultiGet()
+	for _, oData := range oDatas {
+		routing := tc.Routing(oData.Data)
+		if routing == "" {
+			routing = oData.Parent
+		}
+		mget.Add(elastic.NewMultiGetItem().Index(tc.EsIndex).Type(tc.EsType).Id(oData.Id).Routing(routing))
+	}
+
+	res, err := mget.Do(ctx)
+	if err != nil {
+		m.batchLogger(tc.Table).Error("ES mget error", "err", err)
+		return err
+	}
+
+	for i, doc := range res.Docs {
+		if !doc.Found || doc.Source == nil {
+			continue
+		}
+
+		// 備份檔以行為單位 需去除換行
+		buf := bytes.Buffer{}
+		if err := json.Compact(&buf, *doc.Source); err != nil {
+			m.batchLogger(tc.Table).Error("ES doc compact error", "id", doc.Id, "err", err)
+			return err
+		}
+		oDatas[i].EsData = buf.String()
 	}
 
 	return nil
 }
 
+// writeToBackupFile 寫入原資料及變動的 id，同一次執行已備份過的 id 不再寫入原資料，
+// 否則同一個 id 分在多個批次時，後面的批次會把前面寫入的結果當成原資料備份
 func (m *Migration) writeToBackupFile(table string, oDatas []OriginData, changeIds []string) error {
 
+	if m.backedUp == nil {
+		m.backedUp = map[string]bool{}
+	}
+
 	oWriter := bufio.NewWriter(m.oFile)
 	for _, oData := range oDatas {
-		oWriter.WriteString(table + "!@#" + oData.Id + "!@#" + oData.Parent + "!@#" + oData.Data + "\n")
+		if m.backedUp[recordKey(table, oData.Id)] {
+			continue
+		}
+		n, _ := oWriter.WriteString(backup.FormatRecord(table, oData.Id, oData.Parent, oData.Data, oData.Columns, oData.EsData))
+		backupBytes.Add(float64(n))
 	}
 	err := oWriter.Flush()
 	if err != nil {
@@ -253,18 +1000,93 @@ func (m *Migration) writeToBackupFile(table string, oDatas []OriginData, changeI
 	}
 
 	uWriter := bufio.NewWriter(m.uFile)
-	uWriter.WriteString(table + "\n" + strings.Join(changeIds, ",") + "\n")
+	n, _ := uWriter.WriteString(table + "\n" + strings.Join(changeIds, ",") + "\n")
+	backupBytes.Add(float64(n))
 	err = uWriter.Flush()
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
+	// 原本不存在的資料也需記錄，之後的批次不能把新增的資料當成原資料
+	for _, id := range changeIds {
+		m.backedUp[recordKey(table, id)] = true
+	}
+
+	return nil
+}
+
+// loadBackedUp 續跑時讀取原本備份檔內已備份的 (table, id)
+func (m *Migration) loadBackedUp() error {
+
+	m.backedUp = map[string]bool{}
+
+	err := backup.ReadChanges(backup.Dir, m.runId, func(line int, table string, ids []string) error {
+		for _, id := range ids {
+			m.backedUp[recordKey(table, id)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// 寫入中斷的最後一行仍有 id，一併略過
+	return backup.ReadRecords(backup.Dir, m.runId, func(line int, r backup.Record, err error) error {
+		if r.Id != "" {
+			m.backedUp[recordKey(r.Table, r.Id)] = true
+		}
+		return nil
+	})
+}
+
+// writePostHashes 於同一個 transaction 讀取寫入後的資料，將 hash 寫入備份，已刪除的資料 hash 為空
+func (m *Migration) writePostHashes(tx *sql.Tx, tc utils.TableConfig, table string, changeIds []string) error {
+
+	query := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s IN ('%s')", tc.IdIdent(), tc.DataIdent(), table, tc.IdIdent(), strings.Join(changeIds, "','"))
+	start := time.Now()
+	rows, err := tx.Query(query)
+	observePg("select", start)
+	if err != nil {
+		return err
+	}
+
+	hashes := map[string]string{}
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes[id] = DataVersion(data)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	pWriter := bufio.NewWriter(m.pFile)
+	for _, id := range changeIds {
+		n, _ := pWriter.WriteString(backup.FormatPostHash(table, id, hashes[id]))
+		backupBytes.Add(float64(n))
+	}
+	if err := pWriter.Flush(); err != nil {
+		log.Println(err)
+		return err
+	}
+
 	return nil
 }
 
+// DB migration 使用的PG連線
+func (m *Migration) DB() *sql.DB {
+	return m.db
+}
+
 func (m *Migration) Close() {
 
+	m.locker.Close()
+
 	if m.db != nil {
 		m.db.Close()
 	}
@@ -273,11 +1095,18 @@ func (m *Migration) Close() {
 		m.es.Stop()
 	}
 
-	if m.oFile != nil {
-		m.oFile.Close()
+	// 確保備份已寫入磁碟
+	for _, f := range []*os.File{m.oFile, m.uFile, m.pFile, m.cFile} {
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			log.Printf("Sync backup error: %+v", err)
+		}
+		f.Close()
 	}
 
-	if m.uFile != nil {
-		m.uFile.Close()
+	if m.cancel != nil {
+		m.cancel()
 	}
 }
@@ -0,0 +1,80 @@
+package dbMigration
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/meepshop/go-db-migration/pkg/utils"
+)
+
+func TestUpdateRequest(t *testing.T) {
+
+	RegisterEsDocHook("hooked", func(mData MigrationData) (string, error) {
+		return `{"doc": ` + mData.EsData + `}`, nil
+	})
+	defer delete(esDocHooks, "hooked")
+
+	oData := OriginData{Id: "s1", Parent: "p1", Data: `{"n": 9007199254740993, "status": 1, "__parent": "p1"}`}
+
+	tests := []struct {
+		name   string
+		table  string
+		mData  MigrationData
+		action string
+		doc    string
+		sql    string
+	}{
+		{
+			name:   "doc",
+			table:  "store",
+			mData:  MigrationData{Table: "store", Action: "UPDATE", Id: "s1", Doc: `{"status": 0}`},
+			action: `{"index":{"_id":"s1","_parent":"p1","_version":100,"_version_type":"external_gte"}}`,
+			doc:    `{"__parent":"p1","n":9007199254740993,"status":0}`,
+			sql:    `UPDATE store SET "data" = '{"__parent":"p1","n":9007199254740993,"status":0}' WHERE "id" = 's1'`,
+		},
+		{
+			name:   "doc with esData",
+			table:  "store",
+			mData:  MigrationData{Table: "store", Action: "UPDATE", Id: "s1", Doc: `{"status": 0}`, EsData: `{"status": "closed"}`},
+			action: `{"index":{"_id":"s1","_parent":"p1","_version":100,"_version_type":"external_gte"}}`,
+			doc:    `{"status": "closed"}`,
+		},
+		{
+			name:   "doc through hook",
+			table:  "hooked",
+			mData:  MigrationData{Table: "hooked", Action: "UPDATE", Id: "s1", Doc: `{"status": 0}`},
+			action: `{"index":{"_id":"s1","_parent":"p1","_version":100,"_version_type":"external_gte"}}`,
+			doc:    `{"doc": {"__parent":"p1","n":9007199254740993,"status":0}}`,
+		},
+		{
+			name:   "script",
+			table:  "store",
+			mData:  MigrationData{Table: "store", Action: "UPDATE", Id: "s1", Script: &EsScript{Source: "ctx._source.status = 0"}, PgUpdate: `jsonb_set(data, '{status}', '0')`},
+			action: `{"update":{"_id":"s1","_parent":"p1"}}`,
+			doc:    `{"script":{"inline":"ctx._source.status = 0"}}`,
+			sql:    `UPDATE store SET "data" = jsonb_set(data, '{status}', '0') WHERE "id" = 's1'`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			tc := utils.TableConfig{Table: tt.table, ParentPath: "__parent", IdColumn: "id", DataColumn: "data"}
+			update, req, err := updateRequest(tc, tt.mData, oData, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lines, err := req.Source()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(lines, "\n"); got != tt.action+"\n"+tt.doc {
+				t.Errorf("request = %s, want %s\n%s", got, tt.action, tt.doc)
+			}
+			if tt.sql != "" && update.sql != tt.sql {
+				t.Errorf("sql = %s, want %s", update.sql, tt.sql)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package dbMigration
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// CountQuery 以 count(*) 取得 query 的總筆數，供進度計算 ETA
+func (m *Migration) CountQuery(query string) error {
+
+	var total int
+	if err := m.db.QueryRow("SELECT count(*) FROM (" + query + ") AS q").Scan(&total); err != nil {
+		log.Printf("Count query error: %+v", err)
+		return err
+	}
+	m.SetTotal(total)
+
+	return nil
+}
+
+// SetTotal 設定輸入的總筆數，供進度計算 ETA，續跑時扣除略過的筆數
+func (m *Migration) SetTotal(total int) {
+
+	if total -= m.skip; total < 0 {
+		total = 0
+	}
+	m.stats.setTotal(total)
+}
+
+// startProgress 每隔 Progress 輸出一次進度至 stderr，stderr 為終端機時以同一行更新
+func (m *Migration) startProgress() func() {
+
+	if m.Progress <= 0 {
+		return func() {}
+	}
+
+	tty := false
+	if info, err := os.Stderr.Stat(); err == nil {
+		tty = info.Mode()&os.ModeCharDevice != 0
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(m.Progress)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				stats := m.stats.snapshot()
+				if tty {
+					fmt.Fprintf(os.Stderr, "\r\033[K%s", progressLine(stats))
+					continue
+				}
+				fmt.Fprintln(os.Stderr, progressLine(stats))
+				for _, table := range sortedTables(stats.Tables) {
+					c := stats.Tables[table]
+					fmt.Fprintf(os.Stderr, "  %s: upserted %d, updated %d, deleted %d, unchanged %d, conflicts %d\n",
+						table, c.Upserted, c.Updated, c.Deleted, c.Unchanged, c.Conflicts)
+				}
+			case <-done:
+				if tty {
+					fmt.Fprintln(os.Stderr)
+				}
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func progressLine(stats Stats) string {
+
+	parts := []string{}
+	if stats.Total > 0 {
+		parts = append(parts, fmt.Sprintf("%d/%d inputs (%.1f%%)", stats.Inputs, stats.Total, float64(stats.Inputs)*100/float64(stats.Total)))
+	} else {
+		parts = append(parts, fmt.Sprintf("%d inputs", stats.Inputs))
+	}
+
+	written := stats.Upserted + stats.Updated + stats.Deleted
+	parts = append(parts, fmt.Sprintf("%d written, %d unchanged, %d conflicts, %d failed", written, stats.Unchanged, stats.Conflicts, stats.Failed))
+
+	rate := 0.0
+	if stats.Seconds > 0 {
+		rate = float64(stats.Inputs) / stats.Seconds
+	}
+	parts = append(parts, fmt.Sprintf("%.1f inputs/s", rate))
+
+	if stats.Total > 0 && rate > 0 && stats.Inputs < stats.Total {
+		eta := time.Duration(float64(stats.Total-stats.Inputs) / rate * float64(time.Second))
+		parts = append(parts, "ETA "+eta.Round(time.Second).String())
+	}
+
+	return "progress: " + strings.Join(parts, ", ")
+}
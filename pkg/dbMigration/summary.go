@@ -0,0 +1,254 @@
+package dbMigration
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/meepshop/go-db-migration/pkg/backup"
+	"github.com/meepshop/go-db-migration/pkg/history"
+)
+
+// Counts 各動作的筆數
+type Counts struct {
+	Upserted  int `json:"upserted"`
+	Updated   int `json:"updated"`
+	Deleted   int `json:"deleted"`
+	Unchanged int `json:"unchanged"`
+	Conflicts int `json:"conflicts"`
+}
+
+// Stats 執行結果統計，Inputs 為讀取的輸入筆數（query 的資料或 plugin 的輸出行），Total 為已知的總筆數
+type Stats struct {
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	ResumeToken string    `json:"resumeToken,omitempty"`
+	Started     time.Time `json:"started"`
+	Seconds     float64   `json:"seconds"`
+
+	Inputs int `json:"inputs"`
+	Total  int `json:"total,omitempty"`
+	Failed int `json:"failed"`
+	// Attempts 續跑時累計的執行次數
+	Attempts int `json:"attempts,omitempty"`
+	Counts
+	Tables map[string]*Counts `json:"tables"`
+}
+
+// runStats 執行中的統計，進度輸出時會由其他 goroutine 讀取
+type runStats struct {
+	mu sync.Mutex
+	Stats
+}
+
+func newRunStats() *runStats {
+	return &runStats{Stats: Stats{Started: time.Now(), Tables: map[string]*Counts{}}}
+}
+
+// Stats 目前的執行結果統計
+func (m *Migration) Stats() Stats {
+	return m.stats.snapshot()
+}
+
+func (s *runStats) snapshot() Stats {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.Stats
+	stats.Seconds = time.Since(s.Started).Seconds()
+	stats.Tables = map[string]*Counts{}
+	for table, c := range s.Tables {
+		copied := *c
+		stats.Tables[table] = &copied
+	}
+
+	return stats
+}
+
+// count 統計一筆資料，action 為 UPSERT、UPDATE、DELETE、UNCHANGED 或 CONFLICT
+func (s *runStats) count(table string, action string) {
+
+	recordsTotal.WithLabelValues(table, action).Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.Tables[table]
+	if c == nil {
+		c = &Counts{}
+		s.Tables[table] = c
+	}
+
+	for _, counts := range []*Counts{&s.Counts, c} {
+		switch action {
+		case "UPSERT":
+			counts.Upserted += 1
+		case "UPDATE":
+			counts.Updated += 1
+		case "DELETE":
+			counts.Deleted += 1
+		case "UNCHANGED":
+			counts.Unchanged += 1
+		case "CONFLICT":
+			counts.Conflicts += 1
+		}
+	}
+}
+
+func (s *runStats) addInput(failed bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Inputs += 1
+	if failed {
+		s.Failed += 1
+	}
+}
+
+func (s *runStats) setTotal(total int) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Total = total
+}
+
+// countApplied 統計已寫入的資料
+func (m *Migration) countApplied(mDatas []MigrationData) {
+
+	for _, mData := range mDatas {
+		m.stats.count(mData.Table, mData.Action)
+	}
+}
+
+// startHistory 於 migration_runs 記錄開始執行
+func (m *Migration) startHistory(command string, query string) error {
+
+	return history.Start(m.db, history.Run{
+		RunId:      m.runId,
+		StartedAt:  m.stats.Started,
+		Operator:   history.Operator(),
+		Host:       history.Host(),
+		Command:    command,
+		Query:      query,
+		Plugin:     m.Plugin,
+		PluginHash: m.PluginHash,
+		Backup:     m.backupPrefix,
+	})
+}
+
+// finish 執行結束時輸出統計，更新 migration_runs，並將 JSON 格式的報告寫到備份檔旁
+func (m *Migration) finish(err error) {
+
+	m.stats.mu.Lock()
+	switch {
+	case err == nil:
+		m.stats.Status = "completed"
+	case err == errStopped:
+		m.stats.Status = "stopped"
+	default:
+		m.stats.Status = "failed"
+		m.stats.Error = err.Error()
+	}
+	if err != nil {
+		m.stats.ResumeToken = m.ResumeToken()
+	}
+	m.stats.mu.Unlock()
+
+	stats := m.stats.snapshot()
+	if m.previous != nil {
+		stats = mergeStats(*m.previous, stats, m.skip)
+	}
+	log.Printf("Migration %s: inputs %d, failed %d, upserted %d, updated %d, deleted %d, unchanged %d, conflicts %d in %.1fs\n",
+		stats.Status, stats.Inputs, stats.Failed, stats.Upserted, stats.Updated, stats.Deleted, stats.Unchanged, stats.Conflicts, stats.Seconds)
+	m.logResume(err)
+
+	history.Finish(m.db, m.runId, stats.Status, stats.Error, stats)
+
+	b, jsonErr := json.MarshalIndent(stats, "", "  ")
+	if jsonErr != nil {
+		log.Printf("Summary marshal error: %+v", jsonErr)
+		return
+	}
+	if err := ioutil.WriteFile(m.backupPrefix+backup.SummarySuffix, append(b, '\n'), 0644); err != nil {
+		log.Printf("Write summary error: %+v", err)
+	}
+}
+
+func sortedTables(tables map[string]*Counts) []string {
+
+	names := []string{}
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// loadPrevious 續跑時讀取先前的報告，結束時累加，沒有報告時只記錄這次的執行
+func (m *Migration) loadPrevious() {
+
+	b, err := ioutil.ReadFile(m.backupPrefix + backup.SummarySuffix)
+	if err != nil {
+		log.Printf("Previous summary not found, the summary only covers this attempt: %+v", err)
+		return
+	}
+
+	previous := Stats{}
+	if err := json.Unmarshal(b, &previous); err != nil {
+		log.Printf("Previous summary unmarshal error: %+v", err)
+		return
+	}
+	m.previous = &previous
+}
+
+// mergeStats 將續跑的結果累加至先前的報告，skip 為先前已寫入的輸入筆數，
+// 先前未寫入的輸入會再次讀取，因此 Inputs 以 skip 為基準而非先前的 Inputs
+func mergeStats(previous Stats, current Stats, skip int) Stats {
+
+	merged := current
+	merged.Started = previous.Started
+	merged.Seconds = previous.Seconds + current.Seconds
+	merged.Inputs = skip + current.Inputs
+	merged.Failed = previous.Failed + current.Failed
+	if current.Total > 0 {
+		merged.Total = skip + current.Total
+	} else {
+		merged.Total = previous.Total
+	}
+	merged.Attempts = previous.Attempts + 1
+	if previous.Attempts == 0 {
+		merged.Attempts = 2
+	}
+
+	merged.Counts = addCounts(previous.Counts, current.Counts)
+	merged.Tables = map[string]*Counts{}
+	for _, tables := range []map[string]*Counts{previous.Tables, current.Tables} {
+		for table, c := range tables {
+			sum := addCounts(Counts{}, *c)
+			if merged.Tables[table] != nil {
+				sum = addCounts(*merged.Tables[table], *c)
+			}
+			merged.Tables[table] = &sum
+		}
+	}
+
+	return merged
+}
+
+func addCounts(a Counts, b Counts) Counts {
+
+	return Counts{
+		Upserted:  a.Upserted + b.Upserted,
+		Updated:   a.Updated + b.Updated,
+		Deleted:   a.Deleted + b.Deleted,
+		Unchanged: a.Unchanged + b.Unchanged,
+		Conflicts: a.Conflicts + b.Conflicts,
+	}
+}
@@ -0,0 +1,78 @@
+package dbMigration
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMergeStats(t *testing.T) {
+
+	started := time.Date(2018, 3, 21, 9, 30, 0, 0, time.UTC)
+	previous := Stats{
+		Status:   "stopped",
+		Started:  started,
+		Seconds:  10,
+		Inputs:   120,
+		Total:    300,
+		Failed:   1,
+		Counts:   Counts{Upserted: 90, Deleted: 5},
+		Tables:   map[string]*Counts{"a": {Upserted: 90}, "b": {Deleted: 5}},
+		Attempts: 0,
+	}
+
+	tests := []struct {
+		name     string
+		previous Stats
+		current  Stats
+		skip     int
+		want     Stats
+	}{
+		{
+			name:     "first resume",
+			previous: previous,
+			current: Stats{
+				Status:  "completed",
+				Started: started.Add(time.Hour),
+				Seconds: 5,
+				Inputs:  200,
+				Total:   200,
+				Failed:  2,
+				Counts:  Counts{Upserted: 10, Unchanged: 3},
+				Tables:  map[string]*Counts{"a": {Upserted: 10}, "c": {Unchanged: 3}},
+			},
+			skip: 100,
+			want: Stats{
+				Status:   "completed",
+				Started:  started,
+				Seconds:  15,
+				Inputs:   300,
+				Total:    300,
+				Failed:   3,
+				Attempts: 2,
+				Counts:   Counts{Upserted: 100, Deleted: 5, Unchanged: 3},
+				Tables:   map[string]*Counts{"a": {Upserted: 100}, "b": {Deleted: 5}, "c": {Unchanged: 3}},
+			},
+		},
+		{
+			name:     "unknown total",
+			previous: Stats{Started: started, Total: 50, Attempts: 2},
+			current:  Stats{Status: "failed", Error: "x", Inputs: 4},
+			skip:     20,
+			want:     Stats{Status: "failed", Error: "x", Started: started, Inputs: 24, Total: 50, Attempts: 3, Tables: map[string]*Counts{}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeStats(tt.previous, tt.current, tt.skip); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeStats = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// 累加不可修改先前的報告
+	if previous.Tables["a"].Upserted != 90 {
+		t.Errorf("previous stats were modified: %+v", previous.Tables["a"])
+	}
+}
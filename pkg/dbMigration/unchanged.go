@@ -0,0 +1,93 @@
+package dbMigration
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/meepshop/go-db-migration/pkg/utils"
+)
+
+// skipUnchanged 過濾掉與原資料相同的 UPSERT：data、額外欄位與ES文件皆相同時不寫入也不備份
+func (m *Migration) skipUnchanged(tc utils.TableConfig, mDatas []MigrationData, originMap map[string]OriginData) []MigrationData {
+
+	changed := []MigrationData{}
+	for _, mData := range mDatas {
+
+		oData, ok := originMap[mData.Id]
+		if mData.Action != "UPSERT" || !ok || !unchanged(tc, mData, oData) {
+			changed = append(changed, mData)
+			continue
+		}
+
+		m.stats.count(mData.Table, "UNCHANGED")
+	}
+
+	return changed
+}
+
+func unchanged(tc utils.TableConfig, mData MigrationData, oData OriginData) bool {
+
+	if !jsonEqual(mData.Data, oData.Data) {
+		return false
+	}
+
+	// parent 不同時 ES 文件需重新寫入；未設定 parentPath 時無法由 PG 得知原本的 parent
+	if tc.ParentPath == "" {
+		if mData.Parent != "" {
+			return false
+		}
+	} else {
+		parent := mData.Parent
+		if parent == "" {
+			parent = tc.Parent(mData.Data)
+		}
+		if parent != oData.Parent {
+			return false
+		}
+	}
+
+	// 只比對會寫入的額外欄位
+	var columns map[string]interface{}
+	json.Unmarshal([]byte(oData.Columns), &columns)
+	for _, name := range tc.ColumnNames() {
+		v, ok := mData.Columns[name]
+		if !ok && tc.Columns[name] != "" {
+			v, ok = utils.JsonPathValue(mData.Data, tc.Columns[name])
+		}
+		if ok && !jsonEqual(toJson(v), toJson(columns[name])) {
+			return false
+		}
+	}
+
+	if !tc.Synced() {
+		return true
+	}
+	if oData.EsData == "" {
+		return false
+	}
+	doc, err := esDoc(mData)
+	if err != nil {
+		return false
+	}
+
+	return jsonEqual(doc, oData.EsData)
+}
+
+// jsonEqual 以解析後的值比對，忽略 key 順序與空白；數字以原本的字面值比對，避免超過 2^53 的整數被視為相同
+func jsonEqual(a string, b string) bool {
+
+	av, aErr := utils.DecodeJson(a)
+	bv, bErr := utils.DecodeJson(b)
+	if aErr != nil || bErr != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(av, bv)
+}
+
+func toJson(v interface{}) string {
+
+	b, _ := json.Marshal(v)
+
+	return string(b)
+}
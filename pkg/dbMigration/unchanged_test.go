@@ -0,0 +1,100 @@
+package dbMigration
+
+import (
+	"testing"
+
+	"github.com/meepshop/go-db-migration/pkg/utils"
+)
+
+func TestJsonEqual(t *testing.T) {
+
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want bool
+	}{
+		{"same", `{"a": 1}`, `{"a": 1}`, true},
+		{"key order and spaces", `{"a":1,"b":[1,2]}`, `{ "b": [1, 2], "a": 1 }`, true},
+		{"different value", `{"a": 1}`, `{"a": 2}`, false},
+		{"array order", `[1, 2]`, `[2, 1]`, false},
+		{"large integers", `{"a": 9007199254740993}`, `{"a": 9007199254740992}`, false},
+		{"number literal", `{"a": 1}`, `{"a": 1.0}`, false},
+		{"trailing data", `{"a": 1} {}`, `{"a": 1}`, false},
+		{"invalid", `{`, `{`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jsonEqual(tt.a, tt.b); got != tt.want {
+				t.Errorf("jsonEqual(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnchanged(t *testing.T) {
+
+	unsynced := false
+	withParent := utils.TableConfig{Table: "t", ParentPath: "storeId", EsSync: &unsynced, Columns: map[string]string{"status": "status"}}
+	noParent := utils.TableConfig{Table: "t", EsSync: &unsynced}
+
+	tests := []struct {
+		name  string
+		tc    utils.TableConfig
+		mData MigrationData
+		oData OriginData
+		want  bool
+	}{
+		{
+			name:  "same data",
+			tc:    withParent,
+			mData: MigrationData{Data: `{"storeId": "s1", "status": 1}`},
+			oData: OriginData{Data: `{"status": 1, "storeId": "s1"}`, Parent: "s1", Columns: `{"status": 1}`},
+			want:  true,
+		},
+		{
+			name:  "data changed",
+			tc:    withParent,
+			mData: MigrationData{Data: `{"storeId": "s1", "status": 2}`},
+			oData: OriginData{Data: `{"storeId": "s1", "status": 1}`, Parent: "s1", Columns: `{"status": 1}`},
+			want:  false,
+		},
+		{
+			name:  "parent field changed",
+			tc:    withParent,
+			mData: MigrationData{Data: `{"storeId": "s1", "status": 1}`, Parent: "s2"},
+			oData: OriginData{Data: `{"storeId": "s1", "status": 1}`, Parent: "s1", Columns: `{"status": 1}`},
+			want:  false,
+		},
+		{
+			name:  "column changed",
+			tc:    withParent,
+			mData: MigrationData{Data: `{"storeId": "s1", "status": 1}`, Columns: map[string]interface{}{"status": 3}},
+			oData: OriginData{Data: `{"storeId": "s1", "status": 1}`, Parent: "s1", Columns: `{"status": 1}`},
+			want:  false,
+		},
+		{
+			name:  "parent without parent path",
+			tc:    noParent,
+			mData: MigrationData{Data: `{"a": 1}`, Parent: "p"},
+			oData: OriginData{Data: `{"a": 1}`},
+			want:  false,
+		},
+		{
+			name:  "no parent without parent path",
+			tc:    noParent,
+			mData: MigrationData{Data: `{"a": 1}`},
+			oData: OriginData{Data: `{"a": 1}`},
+			want:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unchanged(tt.tc, tt.mData, tt.oData); got != tt.want {
+				t.Errorf("unchanged = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
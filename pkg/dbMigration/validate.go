@@ -0,0 +1,131 @@
+package dbMigration
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/meepshop/go-db-migration/pkg/utils"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Validate 檢查 plugin 輸出的資料格式
+func (m MigrationData) Validate() error {
+
+	if m.Table == "" {
+		return fmt.Errorf("table is empty (id: %s)", m.Id)
+	}
+	if m.Id == "" {
+		return fmt.Errorf("id is empty (table: %s)", m.Table)
+	}
+	// id 會組進 SQL 的 IN ('...')，並以逗號、換行及 !@# 分隔寫入備份檔
+	if strings.ContainsAny(m.Id, "',\r\n") || strings.Contains(m.Id, "!@#") {
+		return fmt.Errorf("id contains a quote, comma, newline or !@# (table: %s, id: %q)", m.Table, m.Id)
+	}
+
+	switch m.Action {
+	case "UPSERT":
+		if !json.Valid([]byte(m.Data)) {
+			return fmt.Errorf("data is not valid json (table: %s, id: %s)", m.Table, m.Id)
+		}
+	case "UPDATE":
+		if (m.Doc == "") == (m.Script == nil) {
+			return fmt.Errorf("update requires either doc or script (table: %s, id: %s)", m.Table, m.Id)
+		}
+		if m.Doc != "" && !json.Valid([]byte(m.Doc)) {
+			return fmt.Errorf("doc is not valid json (table: %s, id: %s)", m.Table, m.Id)
+		}
+		if m.Script != nil && m.PgUpdate == "" {
+			return fmt.Errorf("update script requires pgUpdate (table: %s, id: %s)", m.Table, m.Id)
+		}
+	case "DELETE":
+	default:
+		return fmt.Errorf("unknown action %q (table: %s, id: %s)", m.Action, m.Table, m.Id)
+	}
+
+	if m.EsData != "" && !json.Valid([]byte(m.EsData)) {
+		return fmt.Errorf("esData is not valid json (table: %s, id: %s)", m.Table, m.Id)
+	}
+
+	return nil
+}
+
+// validate 寫入前檢查：資料格式、table 存在於設定檔或PG，以及 data 符合 table 的 JSON Schema
+func (m *Migration) validate(mData MigrationData) error {
+
+	if err := mData.Validate(); err != nil {
+		return err
+	}
+
+	if err := m.checkTable(mData.Table); err != nil {
+		return err
+	}
+
+	if mData.Action != "UPSERT" {
+		return nil
+	}
+
+	schema, err := m.tableSchema(mData.Table)
+	if err != nil || schema == nil {
+		return err
+	}
+
+	var v interface{}
+	json.Unmarshal([]byte(mData.Data), &v)
+	if err := schema.Validate(v); err != nil {
+		return fmt.Errorf("data does not match schema (table: %s, id: %s): %v", mData.Table, mData.Id, err)
+	}
+
+	return nil
+}
+
+// checkTable 確認 table 存在，結果會快取
+func (m *Migration) checkTable(table string) error {
+
+	if m.tables == nil {
+		m.tables = map[string]bool{}
+	}
+
+	exists, checked := m.tables[table]
+	if !checked {
+		if utils.IsConfigured(table) {
+			exists = true
+		} else if err := m.db.QueryRow("SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+			log.Printf("PG catalog error: %+v", err)
+			return err
+		}
+		m.tables[table] = exists
+	}
+
+	if !exists {
+		return errors.New("table not found: " + table)
+	}
+
+	return nil
+}
+
+// tableSchema 取得 table 設定的 JSON Schema，未設定時回傳 nil
+func (m *Migration) tableSchema(table string) (*jsonschema.Schema, error) {
+
+	if m.schemas == nil {
+		m.schemas = map[string]*jsonschema.Schema{}
+	}
+
+	if schema, ok := m.schemas[table]; ok {
+		return schema, nil
+	}
+
+	var schema *jsonschema.Schema
+	if path := utils.GetTableConfig(table).Schema; path != "" {
+		var err error
+		if schema, err = jsonschema.Compile(path); err != nil {
+			log.Printf("Compile schema error Table: %s. %+v\n", table, err)
+			return nil, err
+		}
+	}
+	m.schemas[table] = schema
+
+	return schema, nil
+}
@@ -0,0 +1,42 @@
+package dbMigration
+
+import (
+	"testing"
+)
+
+func TestMigrationDataValidate(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		mData MigrationData
+		err   bool
+	}{
+		{"upsert", MigrationData{Table: "t", Action: "UPSERT", Id: "a", Data: `{"a": 1}`}, false},
+		{"delete", MigrationData{Table: "t", Action: "DELETE", Id: "a"}, false},
+		{"update doc", MigrationData{Table: "t", Action: "UPDATE", Id: "a", Doc: `{"a": 1}`}, false},
+		{"update script", MigrationData{Table: "t", Action: "UPDATE", Id: "a", Script: &EsScript{Source: "ctx._source.a = 1"}, PgUpdate: "data"}, false},
+		{"empty table", MigrationData{Action: "DELETE", Id: "a"}, true},
+		{"empty id", MigrationData{Table: "t", Action: "DELETE"}, true},
+		{"id with quote", MigrationData{Table: "t", Action: "DELETE", Id: "a'b"}, true},
+		{"id with comma", MigrationData{Table: "t", Action: "DELETE", Id: "a,b"}, true},
+		{"id with newline", MigrationData{Table: "t", Action: "DELETE", Id: "a\nb"}, true},
+		{"id with carriage return", MigrationData{Table: "t", Action: "DELETE", Id: "a\rb"}, true},
+		{"id with separator", MigrationData{Table: "t", Action: "DELETE", Id: "a!@#b"}, true},
+		{"unknown action", MigrationData{Table: "t", Action: "MERGE", Id: "a"}, true},
+		{"upsert invalid data", MigrationData{Table: "t", Action: "UPSERT", Id: "a", Data: `{`}, true},
+		{"update without doc or script", MigrationData{Table: "t", Action: "UPDATE", Id: "a"}, true},
+		{"update with doc and script", MigrationData{Table: "t", Action: "UPDATE", Id: "a", Doc: `{}`, Script: &EsScript{}, PgUpdate: "data"}, true},
+		{"update invalid doc", MigrationData{Table: "t", Action: "UPDATE", Id: "a", Doc: `{`}, true},
+		{"update script without pgUpdate", MigrationData{Table: "t", Action: "UPDATE", Id: "a", Script: &EsScript{Source: "x"}}, true},
+		{"invalid esData", MigrationData{Table: "t", Action: "UPSERT", Id: "a", Data: `{}`, EsData: `{`}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.mData.Validate()
+			if (err != nil) != tt.err {
+				t.Errorf("Validate() error = %v, want error %v", err, tt.err)
+			}
+		})
+	}
+}
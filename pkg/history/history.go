@@ -0,0 +1,179 @@
+package history
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"time"
+)
+
+// Run migration_runs 的一筆執行記錄
+type Run struct {
+	RunId      string          `json:"runId"`
+	StartedAt  time.Time       `json:"startedAt"`
+	FinishedAt *time.Time      `json:"finishedAt,omitempty"`
+	Operator   string          `json:"operator"`
+	Host       string          `json:"host"`
+	Command    string          `json:"command"`
+	Query      string          `json:"query,omitempty"`
+	Plugin     string          `json:"plugin,omitempty"`
+	PluginHash string          `json:"pluginHash,omitempty"`
+	Status     string          `json:"status"`
+	Error      string          `json:"error,omitempty"`
+	Backup     string          `json:"backup"`
+	Counts     json.RawMessage `json:"counts,omitempty"`
+}
+
+const createTable = `CREATE TABLE IF NOT EXISTS migration_runs (
+	run_id      text PRIMARY KEY,
+	started_at  timestamptz NOT NULL,
+	finished_at timestamptz,
+	operator    text NOT NULL DEFAULT '',
+	host        text NOT NULL DEFAULT '',
+	command     text NOT NULL DEFAULT '',
+	query       text NOT NULL DEFAULT '',
+	plugin      text NOT NULL DEFAULT '',
+	plugin_hash text NOT NULL DEFAULT '',
+	status      text NOT NULL,
+	error       text NOT NULL DEFAULT '',
+	backup      text NOT NULL DEFAULT '',
+	counts      jsonb
+)`
+
+const columns = `run_id, started_at, finished_at, operator, host, command, query, plugin, plugin_hash, status, error, backup, COALESCE(counts::text, '')`
+
+// Ensure 建立 migration_runs table
+func Ensure(db *sql.DB) error {
+
+	if _, err := db.Exec(createTable); err != nil {
+		log.Printf("Create migration_runs error: %+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// Start 記錄開始執行，同一個 run ID 續跑時更新為執行中
+func Start(db *sql.DB, run Run) error {
+
+	if err := Ensure(db); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(`INSERT INTO migration_runs (run_id, started_at, operator, host, command, query, plugin, plugin_hash, status, backup)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 'running', $9)
+		ON CONFLICT (run_id) DO UPDATE SET finished_at = NULL, operator = $3, host = $4, status = 'running', error = ''`,
+		run.RunId, run.StartedAt, run.Operator, run.Host, run.Command, run.Query, run.Plugin, run.PluginHash, run.Backup)
+	if err != nil {
+		log.Printf("Insert migration_runs error: %+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// Finish 記錄執行結果，counts 為各 table、動作的統計
+func Finish(db *sql.DB, runId string, status string, errMsg string, counts interface{}) error {
+
+	b, err := json.Marshal(counts)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`UPDATE migration_runs SET finished_at = now(), status = $2, error = $3, counts = $4 WHERE run_id = $1`,
+		runId, status, errMsg, string(b))
+	if err != nil {
+		log.Printf("Update migration_runs error: %+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// List 依開始時間由新到舊列出執行記錄
+func List(db *sql.DB, limit int) ([]Run, error) {
+
+	rows, err := db.Query(`SELECT `+columns+` FROM migration_runs ORDER BY started_at DESC LIMIT $1`, limit)
+	if err != nil {
+		log.Printf("Query migration_runs error: %+v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []Run{}
+	for rows.Next() {
+		run, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+// Get 取得一筆執行記錄，不存在時回傳 sql.ErrNoRows
+func Get(db *sql.DB, runId string) (Run, error) {
+	return scan(db.QueryRow(`SELECT `+columns+` FROM migration_runs WHERE run_id = $1`, runId))
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scan(row scanner) (Run, error) {
+
+	run := Run{}
+	var finished *time.Time
+	var counts string
+	err := row.Scan(&run.RunId, &run.StartedAt, &finished, &run.Operator, &run.Host, &run.Command, &run.Query,
+		&run.Plugin, &run.PluginHash, &run.Status, &run.Error, &run.Backup, &counts)
+	if err != nil {
+		return run, err
+	}
+
+	run.FinishedAt = finished
+	if counts != "" {
+		run.Counts = json.RawMessage(counts)
+	}
+
+	return run, nil
+}
+
+// Operator 執行者，優先使用環境變數 MIGRATION_OPERATOR
+func Operator() string {
+
+	if name := os.Getenv("MIGRATION_OPERATOR"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return os.Getenv("USER")
+}
+
+// Host 執行的主機名稱
+func Host() string {
+
+	host, _ := os.Hostname()
+
+	return host
+}
+
+// FileHash 檔案內容的 sha256，讀取失敗時回傳空字串
+func FileHash(path string) string {
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,106 @@
+package history
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// fakeRow 依序將 values 寫入 Scan 的參數
+type fakeRow []interface{}
+
+func (r fakeRow) Scan(dest ...interface{}) error {
+
+	for i, d := range dest {
+		switch d := d.(type) {
+		case *string:
+			*d = r[i].(string)
+		case *time.Time:
+			*d = r[i].(time.Time)
+		case **time.Time:
+			*d, _ = r[i].(*time.Time)
+		}
+	}
+
+	return nil
+}
+
+func TestScan(t *testing.T) {
+
+	started := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	finished := started.Add(time.Minute)
+
+	tests := []struct {
+		name     string
+		finished *time.Time
+		counts   string
+		want     string
+	}{
+		{
+			name: "running without counts",
+			want: `{"runId":"r1","startedAt":"2020-01-02T03:04:05Z","operator":"op","host":"h","command":"migrate","status":"running","backup":"b"}`,
+		},
+		{
+			name:     "finished with counts",
+			finished: &finished,
+			counts:   `{"product":{"UPSERT":2}}`,
+			want:     `{"runId":"r1","startedAt":"2020-01-02T03:04:05Z","finishedAt":"2020-01-02T03:05:05Z","operator":"op","host":"h","command":"migrate","status":"running","backup":"b","counts":{"product":{"UPSERT":2}}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			row := fakeRow{"r1", started, tt.finished, "op", "h", "migrate", "", "", "", "running", "", "b", tt.counts}
+			run, err := scan(row)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := json.Marshal(run)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("scan = %s, want %s", b, tt.want)
+			}
+		})
+	}
+}
+
+func TestOperator(t *testing.T) {
+
+	defer os.Setenv("MIGRATION_OPERATOR", os.Getenv("MIGRATION_OPERATOR"))
+
+	os.Setenv("MIGRATION_OPERATOR", "alice")
+	if got := Operator(); got != "alice" {
+		t.Errorf("Operator = %q, want alice", got)
+	}
+}
+
+func TestFileHash(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("abc")
+	f.Close()
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{f.Name(), "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{f.Name() + ".missing", ""},
+	}
+
+	for _, tt := range tests {
+		if got := FileHash(tt.path); got != tt.want {
+			t.Errorf("FileHash(%s) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package jsPlugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+)
+
+// wrapper 於 JS 內完成 json 轉換，回傳值與 plugin 寫到 stdout 的內容相同
+const wrapper = `(function (data) { return JSON.stringify(migration(JSON.parse(data))) })`
+
+// Plugin 以內嵌的 JS runtime 執行與 pluginExample 相同格式的 plugin，
+// plugin 需以全域的 migration(obj) 回傳 MigrationData 陣列
+type Plugin struct {
+	path    string
+	timeout time.Duration
+	pool    chan *runtime
+}
+
+type runtime struct {
+	vm        *goja.Runtime
+	migration goja.Callable
+}
+
+// Load 載入 plugin 並建立 size 個 runtime 供多個 goroutine 共用，timeout 為每次呼叫的上限，0 為不限制
+func Load(path string, size int, timeout time.Duration) (*Plugin, error) {
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Read js plugin error: %+v", err)
+		return nil, err
+	}
+
+	// 移除 #!/usr/bin/env node，保留行數方便對照錯誤訊息
+	src := string(b)
+	if strings.HasPrefix(src, "#!") {
+		src = "//" + src
+	}
+
+	program, err := goja.Compile(path, src, false)
+	if err != nil {
+		log.Printf("Compile js plugin error: %+v", err)
+		return nil, err
+	}
+
+	if size < 1 {
+		size = 1
+	}
+
+	p := &Plugin{path: path, timeout: timeout, pool: make(chan *runtime, size)}
+	for i := 0; i < size; i++ {
+		rt, err := newRuntime(program)
+		if err != nil {
+			log.Printf("Init js plugin error: %+v", err)
+			return nil, err
+		}
+		p.pool <- rt
+	}
+
+	return p, nil
+}
+
+func newRuntime(program *goja.Program) (*runtime, error) {
+
+	vm := goja.New()
+	noop := func(goja.FunctionCall) goja.Value { return goja.Undefined() }
+
+	// plugin 以 console.log 輸出結果，內嵌執行時改由 migration 的回傳值取得
+	console := vm.NewObject()
+	console.Set("log", noop)
+	console.Set("error", func(call goja.FunctionCall) goja.Value {
+		log.Println(call.Arguments)
+		return goja.Undefined()
+	})
+	vm.Set("console", console)
+
+	// plugin 讀取 stdin 用的 JSONStream 及 process.stdin 不需實際執行
+	vm.Set("require", func(call goja.FunctionCall) goja.Value {
+		stream := vm.NewObject()
+		stream.Set("on", func(goja.FunctionCall) goja.Value { return stream })
+		module := vm.NewObject()
+		module.Set("parse", func(goja.FunctionCall) goja.Value { return stream })
+		return module
+	})
+	stdin := vm.NewObject()
+	stdin.Set("pipe", noop)
+	stdin.Set("on", noop)
+	stdout := vm.NewObject()
+	stdout.Set("write", noop)
+	process := vm.NewObject()
+	process.Set("stdin", stdin)
+	process.Set("stdout", stdout)
+	vm.Set("process", process)
+
+	if _, err := vm.RunProgram(program); err != nil {
+		return nil, err
+	}
+	if _, ok := goja.AssertFunction(vm.Get("migration")); !ok {
+		return nil, errors.New("js plugin does not define function migration(obj)")
+	}
+
+	fn, err := vm.RunString(wrapper)
+	if err != nil {
+		return nil, err
+	}
+	migration, _ := goja.AssertFunction(fn)
+
+	return &runtime{vm: vm, migration: migration}, nil
+}
+
+// Transform 實作 transformer.Transformer，可同時由多個 goroutine 呼叫
+func (p *Plugin) Transform(ctx context.Context, row dbMigration.Row) ([]dbMigration.MigrationData, error) {
+
+	var rt *runtime
+	select {
+	case rt = <-p.pool:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { p.pool <- rt }()
+
+	// 逾時或取消時中斷執行
+	callCtx := ctx
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-callCtx.Done():
+			rt.vm.Interrupt(callCtx.Err())
+		case <-stop:
+		}
+	}()
+
+	res, err := rt.migration(goja.Undefined(), rt.vm.ToValue(row.Data))
+	close(stop)
+	<-done
+	rt.vm.ClearInterrupt()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p.path, err)
+	}
+
+	var mDatas []dbMigration.MigrationData
+	if err := json.Unmarshal([]byte(res.String()), &mDatas); err != nil {
+		return nil, fmt.Errorf("%s: unmarshal result: %v", p.path, err)
+	}
+
+	return mDatas, nil
+}
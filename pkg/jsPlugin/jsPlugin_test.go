@@ -0,0 +1,129 @@
+package jsPlugin
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+)
+
+const plugin = `#!/usr/bin/env node
+function migration(obj) {
+	if (obj.loop) {
+		for (;;) {}
+	}
+	if (obj.throw) {
+		throw new Error("boom")
+	}
+	return [{table: "t", action: "UPSERT", id: obj.id, data: JSON.stringify(obj)}]
+}
+`
+
+func load(t *testing.T, src string, timeout time.Duration) *Plugin {
+
+	dir, err := ioutil.TempDir("", "jsPlugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "plugin.js")
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Load(path, 1, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestTransform(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		data    string
+		timeout time.Duration
+		cancel  bool
+		err     string
+	}{
+		{name: "ok", data: `{"id":"1"}`},
+		{name: "plugin error", data: `{"throw":true}`, err: "boom"},
+		{name: "timeout", data: `{"loop":true}`, timeout: 100 * time.Millisecond, err: "deadline exceeded"},
+		{name: "canceled", data: `{"loop":true}`, cancel: true, err: "canceled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			p := load(t, plugin, tt.timeout)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(100*time.Millisecond, cancel)
+			}
+
+			mDatas, err := p.Transform(ctx, dbMigration.Row{Id: "1", Data: tt.data})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if len(mDatas) != 1 || mDatas[0].Id != "1" || mDatas[0].Data != tt.data {
+				t.Fatalf("Transform = %+v", mDatas)
+			}
+
+			// 中斷或錯誤後 runtime 放回 pool，仍可繼續使用
+			mDatas, err = p.Transform(context.Background(), dbMigration.Row{Id: "2", Data: `{"id":"2"}`})
+			if err != nil {
+				t.Fatalf("Transform after %s: %v", tt.name, err)
+			}
+			if len(mDatas) != 1 || mDatas[0].Id != "2" {
+				t.Fatalf("Transform after %s = %+v", tt.name, mDatas)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+
+	tests := []struct {
+		name string
+		src  string
+		err  bool
+	}{
+		{name: "shebang", src: plugin},
+		{name: "syntax error", src: "function migration(obj {", err: true},
+		{name: "no migration", src: "var x = 1", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			dir, err := ioutil.TempDir("", "jsPlugin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "plugin.js")
+			if err := ioutil.WriteFile(path, []byte(tt.src), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = Load(path, 2, 0)
+			if (err != nil) != tt.err {
+				t.Fatalf("Load err = %v, want error %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package lock
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/meepshop/go-db-migration/pkg/history"
+)
+
+// 所有 lock 使用同一個 classid，避免與其他程式的 advisory lock 衝突
+const namespace = 0x6d696772
+
+// global 全域 lock 的名稱，以 table 模式執行時會持有其 shared lock
+const global = "*"
+
+// appPrefix 持有 lock 的連線以 application_name 標示 run ID
+const appPrefix = "go-db-migration "
+
+const (
+	ModeTable  = "table"
+	ModeGlobal = "global"
+	ModeNone   = "none"
+)
+
+// HeldError lock 已被其他執行持有
+type HeldError struct {
+	Name   string
+	Holder string
+}
+
+func (e *HeldError) Error() string {
+
+	if e.Name == global {
+		return "migration lock is held by " + e.Holder
+	}
+
+	return fmt.Sprintf("migration lock of table %s is held by %s", e.Name, e.Holder)
+}
+
+// Locker 以專用的連線持有 PG advisory lock，連線關閉時 lock 一併釋放
+type Locker struct {
+	conn  *sql.Conn
+	db    *sql.DB
+	mode  string
+	wait  time.Duration
+	owner string
+	held  map[string]bool
+}
+
+// New 取得專用連線，mode 為 none 時回傳 nil，wait 為取得 lock 前最長的等待時間，0 時直接失敗
+func New(ctx context.Context, db *sql.DB, mode string, wait time.Duration, owner string) (*Locker, error) {
+
+	switch mode {
+	case ModeNone:
+		return nil, nil
+	case ModeTable, ModeGlobal:
+	default:
+		return nil, fmt.Errorf("unknown lock mode %q", mode)
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		log.Printf("PG lock connection error: %+v", err)
+		return nil, err
+	}
+
+	// 讓其他執行能由 pg_stat_activity 找到持有者
+	if _, err := conn.ExecContext(ctx, "SELECT set_config('application_name', $1, false)", appPrefix+owner); err != nil {
+		conn.Close()
+		log.Printf("PG set application_name error: %+v", err)
+		return nil, err
+	}
+
+	l := &Locker{conn: conn, db: db, mode: mode, wait: wait, owner: owner, held: map[string]bool{}}
+	if mode == ModeGlobal {
+		if err := l.acquire(ctx, global, false); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// Table 取得 table 的 lock，已持有時直接回傳，global 模式下不需另外取得
+func (l *Locker) Table(ctx context.Context, table string) error {
+
+	if l == nil || l.mode == ModeGlobal || l.held[table] {
+		return nil
+	}
+
+	// 先以 shared 持有全域 lock，避免與 global 模式的執行同時進行
+	if !l.held[global] {
+		if err := l.acquire(ctx, global, true); err != nil {
+			return err
+		}
+	}
+
+	return l.acquire(ctx, table, false)
+}
+
+// Tables 依序取得多個 table 的 lock
+func (l *Locker) Tables(ctx context.Context, tables []string) error {
+
+	for _, table := range tables {
+		if err := l.Table(ctx, table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *Locker) acquire(ctx context.Context, name string, shared bool) error {
+
+	fn := "pg_try_advisory_lock"
+	if shared {
+		fn = "pg_try_advisory_lock_shared"
+	}
+	query := fmt.Sprintf("SELECT %s($1, hashtext($2))", fn)
+
+	deadline := time.Now().Add(l.wait)
+	logged := false
+	for {
+		var ok bool
+		if err := l.conn.QueryRowContext(ctx, query, namespace, name).Scan(&ok); err != nil {
+			log.Printf("PG advisory lock error: %+v", err)
+			return err
+		}
+		if ok {
+			l.held[name] = true
+			return nil
+		}
+
+		heldErr := &HeldError{Name: name, Holder: l.holder(ctx, name)}
+		if !time.Now().Before(deadline) {
+			return heldErr
+		}
+		if !logged {
+			log.Printf("%s, waiting up to %s", heldErr.Error(), time.Until(deadline).Round(time.Second))
+			logged = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// holder 由 pg_locks 找出持有 lock 的連線，並以 migration_runs 說明是哪一次執行
+func (l *Locker) holder(ctx context.Context, name string) string {
+
+	rows, err := l.conn.QueryContext(ctx, `SELECT a.pid, COALESCE(a.application_name, ''), COALESCE(host(a.client_addr), 'local'), a.backend_start
+		FROM pg_locks k JOIN pg_stat_activity a ON a.pid = k.pid
+		WHERE k.locktype = 'advisory' AND k.granted AND k.objsubid = 2
+			AND k.classid = $1::int::oid AND k.objid = hashtext($2)::oid AND k.pid <> pg_backend_pid()`, namespace, name)
+	if err != nil {
+		log.Printf("PG lock holder error: %+v", err)
+		return "unknown"
+	}
+	defer rows.Close()
+
+	holders := []string{}
+	for rows.Next() {
+		var pid int
+		var app, addr string
+		var since time.Time
+		if err := rows.Scan(&pid, &app, &addr, &since); err != nil {
+			log.Printf("PG lock holder scan error: %+v", err)
+			break
+		}
+		holders = append(holders, l.describe(pid, app, addr, since))
+	}
+	if len(holders) == 0 {
+		return "unknown"
+	}
+
+	return strings.Join(holders, ", ")
+}
+
+func (l *Locker) describe(pid int, app string, addr string, since time.Time) string {
+
+	if strings.HasPrefix(app, appPrefix) {
+		runId := strings.TrimPrefix(app, appPrefix)
+		if run, err := history.Get(l.db, runId); err == nil {
+			return fmt.Sprintf("run %s (%s by %s@%s, started %s)", run.RunId, run.Command, run.Operator, run.Host, run.StartedAt.Format(time.RFC3339))
+		}
+		return fmt.Sprintf("run %s (pid %d from %s)", runId, pid, addr)
+	}
+
+	return fmt.Sprintf("pid %d (%s from %s since %s)", pid, app, addr, since.Format(time.RFC3339))
+}
+
+// Close 釋放所有 lock 並歸還連線
+func (l *Locker) Close() {
+
+	if l == nil {
+		return
+	}
+
+	if _, err := l.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock_all()"); err != nil {
+		log.Printf("PG advisory unlock error: %+v", err)
+	}
+	l.conn.Close()
+}
@@ -0,0 +1,70 @@
+package lock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHeldError(t *testing.T) {
+
+	tests := []struct {
+		name string
+		err  HeldError
+		want string
+	}{
+		{"global", HeldError{Name: global, Holder: "run r1"}, "migration lock is held by run r1"},
+		{"table", HeldError{Name: "product", Holder: "pid 12"}, "migration lock of table product is held by pid 12"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.err.Error(); got != tt.want {
+				t.Errorf("Error() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMode(t *testing.T) {
+
+	tests := []struct {
+		mode string
+		err  bool
+	}{
+		{ModeNone, false},
+		{"", true},
+		{"tables", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+
+			// none 及不支援的模式不會使用連線
+			l, err := New(context.Background(), nil, tt.mode, 0, "r1")
+			if (err != nil) != tt.err {
+				t.Fatalf("New err = %v, want error %v", err, tt.err)
+			}
+			if l != nil {
+				t.Fatalf("New = %+v, want nil", l)
+			}
+
+			// 沒有 lock 時不需取得也不需釋放
+			if err := l.Tables(context.Background(), []string{"a", "b"}); err != nil {
+				t.Errorf("Tables err = %v", err)
+			}
+			l.Close()
+		})
+	}
+}
+
+func TestDescribe(t *testing.T) {
+
+	since := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	l := &Locker{}
+
+	want := "pid 12 (psql from 10.0.0.1 since 2020-01-02T03:04:05Z)"
+	if got := l.describe(12, "psql", "10.0.0.1", since); got != want {
+		t.Errorf("describe = %q, want %q", got, want)
+	}
+}
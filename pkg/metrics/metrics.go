@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry migration 的 metric，不含 Go runtime 的預設 metric
+var Registry = prometheus.NewRegistry()
+
+// Factory 建立並註冊於 Registry 的 metric
+var Factory = promauto.With(Registry)
+
+// Handler 提供 /metrics 的 http handler
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Serve 於背景啟動 http server，於 addr 的 /metrics 提供 metric
+func Serve(addr string) {
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Metrics server error: %+v", err)
+		}
+	}()
+}
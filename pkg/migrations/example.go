@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+	"github.com/meepshop/go-db-migration/pkg/transformer"
+)
+
+// 與 pluginExample 相同的 UPSERT 轉換，不包含其示範用的 DELETE，以 --transformer=example 執行
+func init() {
+	transformer.Register("example", transformer.Func(example))
+}
+
+func example(ctx context.Context, row dbMigration.Row) ([]dbMigration.MigrationData, error) {
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(row.Data), &obj); err != nil {
+		return nil, err
+	}
+
+	obj["updatedAt"] = "2017-12-25T00:00:00.000000+00:00"
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return []dbMigration.MigrationData{
+		{
+			Table:  "activitycouponcode",
+			Action: "UPSERT",
+			Id:     row.Id,
+			Data:   string(data),
+		},
+	}, nil
+}
@@ -0,0 +1,75 @@
+package migrations
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+	"github.com/meepshop/go-db-migration/pkg/transformer"
+)
+
+func TestExample(t *testing.T) {
+
+	tests := []struct {
+		name string
+		row  dbMigration.Row
+		data map[string]interface{}
+		err  bool
+	}{
+		{
+			name: "sets updatedAt",
+			row:  dbMigration.Row{Id: "a", Data: `{"id": "a", "code": "X1"}`},
+			data: map[string]interface{}{"id": "a", "code": "X1", "updatedAt": "2017-12-25T00:00:00.000000+00:00"},
+		},
+		{
+			name: "overwrites updatedAt",
+			row:  dbMigration.Row{Id: "b", Data: `{"updatedAt": "2016-01-01T00:00:00.000000+00:00"}`},
+			data: map[string]interface{}{"updatedAt": "2017-12-25T00:00:00.000000+00:00"},
+		},
+		{
+			name: "invalid data",
+			row:  dbMigration.Row{Id: "c", Data: `{`},
+			err:  true,
+		},
+	}
+
+	tr, err := transformer.Get("example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			mDatas, err := tr.Transform(context.Background(), tt.row)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// 只有 UPSERT，沒有 pluginExample 的 DELETE
+			if len(mDatas) != 1 {
+				t.Fatalf("got %d records, want 1", len(mDatas))
+			}
+			mData := mDatas[0]
+			if mData.Table != "activitycouponcode" || mData.Action != "UPSERT" || mData.Id != tt.row.Id {
+				t.Errorf("got %s %s %s", mData.Table, mData.Action, mData.Id)
+			}
+
+			var data map[string]interface{}
+			if err := json.Unmarshal([]byte(mData.Data), &data); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(data, tt.data) {
+				t.Errorf("got %v, want %v", data, tt.data)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package pipePlugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+)
+
+// Plugin 與 --consumer 相同協定的 plugin：stdin 每行一筆 query 出的資料，stdout 每行回傳一個轉換結果陣列，
+// plugin 需每讀一筆即輸出一行
+type Plugin struct {
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	reader *bufio.Reader
+}
+
+// Load 啟動 plugin
+func Load(command string) (*Plugin, error) {
+
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("plugin command is empty")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("Start plugin error: %+v", err)
+		return nil, err
+	}
+
+	return &Plugin{cmd: cmd, stdin: stdin, reader: bufio.NewReader(stdout)}, nil
+}
+
+// Transform 實作 transformer.Transformer，同時只會處理一筆
+func (p *Plugin) Transform(ctx context.Context, row dbMigration.Row) ([]dbMigration.MigrationData, error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, err := io.WriteString(p.stdin, row.Data+"\n"); err != nil {
+		return nil, fmt.Errorf("write plugin ID: %s: %v", row.Id, err)
+	}
+
+	line, err := p.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("read plugin ID: %s: %v", row.Id, err)
+	}
+
+	var mDatas []dbMigration.MigrationData
+	if err := json.Unmarshal(line, &mDatas); err != nil {
+		return nil, fmt.Errorf("unmarshal plugin result ID: %s: %v", row.Id, err)
+	}
+
+	return mDatas, nil
+}
+
+// Close 關閉 plugin 的 stdin 並等待結束
+func (p *Plugin) Close() {
+
+	p.stdin.Close()
+	p.cmd.Wait()
+}
@@ -0,0 +1,261 @@
+package pluginHarness
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+	"github.com/meepshop/go-db-migration/pkg/transformer"
+)
+
+// Case golden 檔內的一筆測試資料，data、esData、doc 會轉為 json 物件方便閱讀
+type Case struct {
+	Input  interface{}   `json:"input"`
+	Output []interface{} `json:"output"`
+}
+
+// Run 將 fixtures（NDJSON，每行一筆 query 出的 data）逐筆交給 plugin，
+// 檢查輸出格式並與 golden 比對，update 為 true 時改為寫入新的 golden，輸出不合格時不寫入．
+// 結果寫到 out，全部通過時回傳 true
+func Run(ctx context.Context, t transformer.Transformer, fixtures string, golden string, update bool, out io.Writer) (bool, error) {
+
+	f, err := os.Open(fixtures)
+	if err != nil {
+		log.Printf("Open fixtures error: %+v", err)
+		return false, err
+	}
+	defer f.Close()
+
+	actual := []Case{}
+	invalid := map[int][]string{}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var input map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &input); err != nil {
+			return false, fmt.Errorf("fixture %d is not a json object: %v", len(actual)+1, err)
+		}
+
+		row := dbMigration.Row{Data: line}
+		if id := input["id"]; id != nil {
+			row.Id = fmt.Sprint(id)
+		}
+		mDatas, err := t.Transform(ctx, row)
+		if err != nil {
+			return false, fmt.Errorf("fixture %d (id: %s): %v", len(actual)+1, row.Id, err)
+		}
+
+		c := Case{Input: input, Output: []interface{}{}}
+		for _, mData := range mDatas {
+			if err := mData.Validate(); err != nil {
+				invalid[len(actual)] = append(invalid[len(actual)], err.Error())
+			}
+			c.Output = append(c.Output, normalize(mData))
+		}
+		actual = append(actual, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+
+	if update {
+		// 輸出不合格時不寫入 golden，避免錯誤的結果成為預期值
+		if !reportInvalid(invalid, out) {
+			fmt.Fprintf(out, "FAIL: golden %s not updated, %d cases have invalid output\n", golden, len(invalid))
+			return false, nil
+		}
+		b, err := json.MarshalIndent(actual, "", "  ")
+		if err != nil {
+			return false, err
+		}
+		if err := ioutil.WriteFile(golden, append(b, '\n'), 0644); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(out, "golden %s updated with %d cases\n", golden, len(actual))
+		return true, nil
+	}
+
+	b, err := ioutil.ReadFile(golden)
+	if err != nil {
+		log.Printf("Read golden error: %+v", err)
+		return false, err
+	}
+	expected := []Case{}
+	if err := json.Unmarshal(b, &expected); err != nil {
+		return false, fmt.Errorf("golden %s: %v", golden, err)
+	}
+
+	ok := reportInvalid(invalid, out)
+	if len(expected) != len(actual) {
+		fmt.Fprintf(out, "FAIL: golden has %d cases, fixtures produced %d\n", len(expected), len(actual))
+		ok = false
+	}
+
+	failed := 0
+	for i := 0; i < len(expected) && i < len(actual); i++ {
+		diffs := []string{}
+		diff("input", expected[i].Input, actual[i].Input, &diffs)
+		diff("output", toGeneric(expected[i].Output), toGeneric(actual[i].Output), &diffs)
+		if len(diffs) == 0 {
+			continue
+		}
+
+		failed += 1
+		fmt.Fprintf(out, "--- case %d (id: %v)\n", i+1, idOf(actual[i].Input))
+		for _, d := range diffs {
+			fmt.Fprintln(out, "  "+d)
+		}
+	}
+
+	if failed > 0 {
+		ok = false
+	}
+	if ok {
+		fmt.Fprintf(out, "ok: %d cases\n", len(actual))
+	} else {
+		fmt.Fprintf(out, "FAIL: %d of %d cases differ from golden\n", failed, len(actual))
+	}
+
+	return ok, nil
+}
+
+func reportInvalid(invalid map[int][]string, out io.Writer) bool {
+
+	cases := []int{}
+	for i := range invalid {
+		cases = append(cases, i)
+	}
+	sort.Ints(cases)
+
+	for _, i := range cases {
+		fmt.Fprintf(out, "--- case %d: invalid output\n", i+1)
+		for _, msg := range invalid[i] {
+			fmt.Fprintln(out, "  "+msg)
+		}
+	}
+
+	return len(invalid) == 0
+}
+
+// normalize 將資料轉為一般 json 結構，字串內的 json 轉為物件
+func normalize(mData dbMigration.MigrationData) interface{} {
+
+	b, _ := json.Marshal(mData)
+	var m map[string]interface{}
+	json.Unmarshal(b, &m)
+
+	for _, key := range []string{"data", "esData", "doc"} {
+		s, ok := m[key].(string)
+		if !ok || s == "" {
+			continue
+		}
+		var v interface{}
+		if json.Unmarshal([]byte(s), &v) == nil {
+			m[key] = v
+		}
+	}
+
+	return m
+}
+
+func toGeneric(v interface{}) interface{} {
+
+	b, _ := json.Marshal(v)
+	var g interface{}
+	json.Unmarshal(b, &g)
+
+	return g
+}
+
+func idOf(input interface{}) interface{} {
+
+	if m, ok := input.(map[string]interface{}); ok {
+		return m["id"]
+	}
+
+	return nil
+}
+
+// diff 逐層比對，差異以 path: expected ..., got ... 表示
+func diff(path string, expected interface{}, actual interface{}, diffs *[]string) {
+
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := map[string]bool{}
+		for k := range e {
+			keys[k] = true
+		}
+		for k := range a {
+			keys[k] = true
+		}
+		sorted := []string{}
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+
+		for _, k := range sorted {
+			ev, eok := e[k]
+			av, aok := a[k]
+			switch {
+			case !aok:
+				*diffs = append(*diffs, fmt.Sprintf("%s.%s: missing, expected %s", path, k, show(ev)))
+			case !eok:
+				*diffs = append(*diffs, fmt.Sprintf("%s.%s: unexpected %s", path, k, show(av)))
+			default:
+				diff(path+"."+k, ev, av, diffs)
+			}
+		}
+		return
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok {
+			break
+		}
+
+		for i := 0; i < len(e) || i < len(a); i++ {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(a):
+				*diffs = append(*diffs, fmt.Sprintf("%s: missing, expected %s", p, show(e[i])))
+			case i >= len(e):
+				*diffs = append(*diffs, fmt.Sprintf("%s: unexpected %s", p, show(a[i])))
+			default:
+				diff(p, e[i], a[i], diffs)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		*diffs = append(*diffs, fmt.Sprintf("%s: expected %s, got %s", path, show(expected), show(actual)))
+	}
+}
+
+func show(v interface{}) string {
+
+	b, _ := json.Marshal(v)
+
+	return string(b)
+}
@@ -0,0 +1,117 @@
+package pluginHarness
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+	"github.com/meepshop/go-db-migration/pkg/transformer"
+)
+
+// upsert 將每筆資料原樣 UPSERT，extra 可修改指定 id 的 data
+func upsert(action string, extra map[string]string) transformer.Func {
+	return func(ctx context.Context, row dbMigration.Row) ([]dbMigration.MigrationData, error) {
+		data := row.Data
+		if s, ok := extra[row.Id]; ok {
+			data = strings.TrimSuffix(data, "}") + ", " + s + "}"
+		}
+		return []dbMigration.MigrationData{{Table: "t", Action: action, Id: row.Id, Data: data}}, nil
+	}
+}
+
+func TestRun(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		transform transformer.Func
+		update    bool
+		ok        bool
+		contains  []string
+	}{
+		{
+			name:      "golden match",
+			transform: upsert("UPSERT", nil),
+			ok:        true,
+			contains:  []string{"ok: 2 cases"},
+		},
+		{
+			name:      "mismatch diff",
+			transform: upsert("UPSERT", map[string]string{"a2": `"x": 1`}),
+			contains:  []string{"--- case 2 (id: a2)", "output[0].data.x: unexpected 1", "FAIL: 1 of 2 cases differ from golden"},
+		},
+		{
+			name:      "update rewrites golden",
+			transform: upsert("UPSERT", map[string]string{"a2": `"x": 1`}),
+			update:    true,
+			ok:        true,
+			contains:  []string{"updated with 2 cases"},
+		},
+		{
+			name:      "invalid output",
+			transform: upsert("MERGE", nil),
+			contains:  []string{"--- case 1: invalid output", `unknown action "MERGE"`},
+		},
+		{
+			name:      "invalid output is rejected on update",
+			transform: upsert("MERGE", nil),
+			update:    true,
+			contains:  []string{"--- case 2: invalid output", "not updated, 2 cases have invalid output"},
+		},
+	}
+
+	ctx := context.Background()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			dir, err := ioutil.TempDir("", "pluginHarness")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			fixtures := filepath.Join(dir, "fixtures.ndjson")
+			golden := filepath.Join(dir, "expected.json")
+			if err := ioutil.WriteFile(fixtures, []byte("{\"id\": \"a1\", \"n\": 1}\n\n{\"id\": \"a2\", \"n\": 2}\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Run(ctx, upsert("UPSERT", nil), fixtures, golden, true, ioutil.Discard); err != nil {
+				t.Fatal(err)
+			}
+			before, _ := ioutil.ReadFile(golden)
+
+			out := &bytes.Buffer{}
+			ok, err := Run(ctx, tt.transform, fixtures, golden, tt.update, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.ok {
+				t.Errorf("Run = %v, want %v\n%s", ok, tt.ok, out)
+			}
+			for _, s := range tt.contains {
+				if !strings.Contains(out.String(), s) {
+					t.Errorf("output does not contain %q\n%s", s, out)
+				}
+			}
+
+			after, _ := ioutil.ReadFile(golden)
+			if changed := !bytes.Equal(before, after); changed != (tt.update && tt.ok) {
+				t.Errorf("golden changed = %v", changed)
+			}
+			if !tt.update || !tt.ok {
+				return
+			}
+
+			// 更新後的 golden 與同一個 plugin 的輸出相符
+			out.Reset()
+			if ok, err := Run(ctx, tt.transform, fixtures, golden, false, out); err != nil || !ok {
+				t.Errorf("Run after update = %v, %v\n%s", ok, err, out)
+			}
+		})
+	}
+}
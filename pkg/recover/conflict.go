@@ -0,0 +1,244 @@
+package recover
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/meepshop/go-db-migration/pkg/backup"
+	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+	"github.com/meepshop/go-db-migration/pkg/utils"
+)
+
+// 還原時遇到 migration 之後又被修改的資料的處理方式
+const (
+	// OnConflictReport 列出被修改的資料並中斷，不做任何變更
+	OnConflictReport = "report"
+	// OnConflictSkip 略過被修改的資料，其餘照常還原
+	OnConflictSkip = "skip"
+	// OnConflictForce 仍以備份覆蓋
+	OnConflictForce = "force"
+)
+
+// Modified migration 之後又被修改的資料，Current 為目前資料的 hash，已刪除時為空
+type Modified struct {
+	Table   string
+	Id      string
+	Post    string
+	Current string
+}
+
+func key(table string, id string) string {
+	return table + "\x00" + id
+}
+
+// readChanges 讀取 upsertID，回傳符合條件的 table 與以逗號分隔的 id，
+// 同一個 id 跨批次變動時會重複記錄，只保留第一次
+func (r *Recover) readChanges() ([][]string, error) {
+
+	seen := map[string]bool{}
+	allDeleteIDs := [][]string{}
+	err := backup.ReadChanges(backup.Dir, r.id, func(line int, table string, ids []string) error {
+		unique := []string{}
+		for _, id := range r.Filter.ids(table, ids) {
+			if !seen[key(table, id)] {
+				seen[key(table, id)] = true
+				unique = append(unique, id)
+			}
+		}
+		if len(unique) > 0 {
+			allDeleteIDs = append(allDeleteIDs, []string{table, strings.Join(unique, ",")})
+		}
+		return nil
+	})
+
+	return allDeleteIDs, err
+}
+
+// postHashes 讀取備份的 postHash，同一筆資料以最後寫入的為準，舊版備份回傳 nil
+func (r *Recover) postHashes() (map[string]string, error) {
+
+	hashes := map[string]string{}
+	err := backup.ReadPostHashes(backup.Dir, r.id, func(line int, p backup.PostHash, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s line %d: %v", backup.PostSuffix, line, err)
+		}
+		hashes[key(p.Table, p.Id)] = p.Hash
+		return nil
+	})
+	if os.IsNotExist(err) {
+		log.Println("Backup has no post-migration hashes, changes made after the migration cannot be detected")
+		return nil, nil
+	} else if err != nil {
+		log.Printf("Read post hash error: %+v", err)
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+// modified 比對目前資料與 migration 寫入後的 hash，找出之後又被修改的資料
+func (r *Recover) modified(allDeleteIDs [][]string) ([]Modified, error) {
+
+	hashes, err := r.postHashes()
+	if err != nil || hashes == nil {
+		return nil, err
+	}
+
+	modified := []Modified{}
+	for _, delIDs := range allDeleteIDs {
+
+		tc := utils.GetTableConfig(delIDs[0])
+		idArr := strings.Split(delIDs[1], ",")
+
+		query := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s IN ('%s')", tc.IdIdent(), tc.DataIdent(), delIDs[0], tc.IdIdent(), strings.Join(idArr, "','"))
+		rows, err := r.db.Query(query)
+		if err != nil {
+			log.Printf("Recover pg query error: %+v", err)
+			return nil, err
+		}
+
+		current := map[string]string{}
+		for rows.Next() {
+			var id, data string
+			if err := rows.Scan(&id, &data); err != nil {
+				rows.Close()
+				log.Printf("Recover pg scan error: %+v", err)
+				return nil, err
+			}
+			current[id] = dbMigration.DataVersion(data)
+		}
+		rows.Close()
+
+		for _, id := range idArr {
+			// 沒有記錄 hash 的資料無法判斷
+			post, ok := hashes[key(delIDs[0], id)]
+			if ok && current[id] != post {
+				modified = append(modified, Modified{Table: delIDs[0], Id: id, Post: post, Current: current[id]})
+			}
+		}
+	}
+
+	return modified, nil
+}
+
+// resolve 依 OnConflict 處理被修改的資料，skip 時將其排除後重新過濾 upsertID
+func (r *Recover) resolve(allDeleteIDs [][]string, modified []Modified) ([][]string, error) {
+
+	if len(modified) == 0 {
+		return allDeleteIDs, nil
+	}
+
+	for _, m := range modified {
+		log.Printf("Modified since migration: %s %s (%s)\n", m.Table, m.Id, describe(m))
+	}
+
+	switch r.onConflict() {
+	case OnConflictForce:
+		log.Printf("Overwriting %d records modified since the migration\n", len(modified))
+		return allDeleteIDs, nil
+	case OnConflictSkip:
+		log.Printf("Skipping %d records modified since the migration\n", len(modified))
+		r.Filter.exclude(modified)
+		kept := [][]string{}
+		for _, delIDs := range allDeleteIDs {
+			if ids := r.Filter.ids(delIDs[0], strings.Split(delIDs[1], ",")); len(ids) > 0 {
+				kept = append(kept, []string{delIDs[0], strings.Join(ids, ",")})
+			}
+		}
+		return kept, nil
+	default:
+		return nil, fmt.Errorf("%d records were modified since the migration, recover with --on-conflict=skip or --on-conflict=force", len(modified))
+	}
+}
+
+func (r *Recover) onConflict() string {
+
+	if r.OnConflict == "" {
+		return OnConflictReport
+	}
+
+	return r.OnConflict
+}
+
+func describe(m Modified) string {
+
+	switch {
+	case m.Current == "":
+		return "deleted"
+	case m.Post == "":
+		return "recreated"
+	default:
+		return "updated"
+	}
+}
+
+// plan dry-run：列出還原會刪除或寫回的資料及 migration 之後被修改的資料，不做任何變更
+func (r *Recover) plan() error {
+
+	allDeleteIDs, err := r.readChanges()
+	if err != nil {
+		return err
+	}
+	modified, err := r.modified(allDeleteIDs)
+	if err != nil {
+		return err
+	}
+
+	conflicts := map[string]Modified{}
+	for _, m := range modified {
+		conflicts[key(m.Table, m.Id)] = m
+	}
+
+	// 有原資料的 id 會寫回，沒有的代表是 migration 新增的，只會刪除
+	origins := map[string]bool{}
+	err = backup.ReadRecords(backup.Dir, r.id, func(line int, bo backup.Record, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s line %d: %v", backup.OriginSuffix, line, err)
+		}
+		if r.Filter.record(bo.Table, bo.Id) {
+			origins[key(bo.Table, bo.Id)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	counts := map[string]int{}
+	for _, delIDs := range allDeleteIDs {
+		for _, id := range strings.Split(delIDs[1], ",") {
+			action := "delete"
+			if origins[key(delIDs[0], id)] {
+				action = "restore"
+			}
+			note := ""
+			if m, ok := conflicts[key(delIDs[0], id)]; ok {
+				note = "  modified since migration: " + describe(m)
+				if r.onConflict() == OnConflictSkip {
+					action = "skip"
+				} else if r.onConflict() == OnConflictReport {
+					action = "conflict"
+				}
+			}
+			counts[action] += 1
+			fmt.Printf("%-8s %s %s%s\n", action, delIDs[0], id, note)
+		}
+	}
+
+	actions := []string{}
+	for action := range counts {
+		actions = append(actions, fmt.Sprintf("%s %d", action, counts[action]))
+	}
+	sort.Strings(actions)
+	fmt.Printf("Dry run of %s (on conflict: %s): %s\n", r.id, r.onConflict(), strings.Join(actions, ", "))
+
+	if counts["conflict"] > 0 {
+		return errors.New("recover would stop: records were modified since the migration")
+	}
+
+	return nil
+}
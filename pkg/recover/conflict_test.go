@@ -0,0 +1,63 @@
+package recover
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+
+	allDeleteIDs := [][]string{{"orders", "o1,o2"}, {"users", "u1"}}
+	modified := []Modified{{Table: "orders", Id: "o2", Post: "h2", Current: "h3"}, {Table: "users", Id: "u1", Post: "h1"}}
+
+	tests := []struct {
+		name       string
+		onConflict string
+		modified   []Modified
+		want       [][]string
+		err        bool
+	}{
+		{"no conflicts", "", nil, allDeleteIDs, false},
+		{"report by default", "", modified, nil, true},
+		{"report", OnConflictReport, modified, nil, true},
+		{"force", OnConflictForce, modified, allDeleteIDs, false},
+		{"skip", OnConflictSkip, modified, [][]string{{"orders", "o1"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			r := &Recover{OnConflict: tt.onConflict}
+			got, err := r.resolve(allDeleteIDs, tt.modified)
+			if (err != nil) != tt.err {
+				t.Fatalf("resolve error = %v, want error %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolve = %v, want %v", got, tt.want)
+			}
+			if tt.onConflict == OnConflictSkip && r.Filter.record("orders", "o2") {
+				t.Error("skipped record should be excluded from the origin data")
+			}
+		})
+	}
+}
+
+func TestDescribe(t *testing.T) {
+
+	tests := []struct {
+		modified Modified
+		want     string
+	}{
+		{Modified{Post: "h1", Current: "h2"}, "updated"},
+		{Modified{Post: "h1"}, "deleted"},
+		{Modified{Current: "h2"}, "recreated"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := describe(tt.modified); got != tt.want {
+				t.Errorf("describe(%+v) = %s, want %s", tt.modified, got, tt.want)
+			}
+		})
+	}
+}
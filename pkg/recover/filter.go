@@ -0,0 +1,179 @@
+package recover
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/meepshop/go-db-migration/pkg/backup"
+	"github.com/meepshop/go-db-migration/pkg/transform"
+)
+
+// Filter 只還原部分資料，條件皆為空時還原全部；
+// upsertID 與 originData 以相同的 (table, id) 過濾，Where 只能判斷有原資料的 id
+type Filter struct {
+	Tables map[string]bool
+	Ids    map[string]bool
+	Where  []transform.Condition
+
+	// matched 符合 Where 的 (table, id)，excluded 因衝突略過的 (table, id)
+	matched  map[string]bool
+	excluded map[string]bool
+}
+
+// NewFilter tables、ids 以逗號分隔，idsFile 每行一個 id，where 格式與 transform spec 的 when 相同
+func NewFilter(tables string, ids string, idsFile string, where string) (Filter, error) {
+
+	f := Filter{Tables: splitSet(tables), Ids: splitSet(ids)}
+
+	if idsFile != "" {
+		b, err := ioutil.ReadFile(idsFile)
+		if err != nil {
+			log.Printf("Read ids file error: %+v", err)
+			return f, err
+		}
+		for _, id := range strings.Split(string(b), "\n") {
+			if id = strings.TrimSpace(id); id != "" {
+				f.Ids[id] = true
+			}
+		}
+	}
+
+	if where != "" {
+		conds, err := transform.ParseConditions(where)
+		if err != nil {
+			log.Printf("Parse where error: %+v", err)
+			return f, err
+		}
+		f.Where = conds
+	}
+
+	return f, nil
+}
+
+func splitSet(s string) map[string]bool {
+
+	set := map[string]bool{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			set[v] = true
+		}
+	}
+
+	return set
+}
+
+// Empty 沒有任何條件
+func (f Filter) Empty() bool {
+	return len(f.Tables) == 0 && len(f.Ids) == 0 && len(f.Where) == 0 && len(f.excluded) == 0
+}
+
+// String 記錄於 migration_runs 的條件說明
+func (f Filter) String() string {
+
+	parts := []string{}
+	if len(f.Tables) > 0 {
+		parts = append(parts, "tables="+joinSet(f.Tables))
+	}
+	if len(f.Ids) > 0 {
+		parts = append(parts, "ids="+joinSet(f.Ids))
+	}
+	if len(f.Where) > 0 {
+		b, _ := json.Marshal(f.Where)
+		parts = append(parts, "where="+string(b))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func joinSet(set map[string]bool) string {
+
+	list := []string{}
+	for v := range set {
+		list = append(list, v)
+	}
+	sort.Strings(list)
+
+	return strings.Join(list, ",")
+}
+
+func (f Filter) table(table string) bool {
+	return len(f.Tables) == 0 || f.Tables[table]
+}
+
+func (f Filter) record(table string, id string) bool {
+
+	if !f.table(table) || (len(f.Ids) > 0 && !f.Ids[id]) || f.excluded[key(table, id)] {
+		return false
+	}
+
+	return len(f.Where) == 0 || f.matched[key(table, id)]
+}
+
+// exclude 排除 migration 之後被修改的資料
+func (f *Filter) exclude(modified []Modified) {
+
+	if f.excluded == nil {
+		f.excluded = map[string]bool{}
+	}
+	for _, m := range modified {
+		f.excluded[key(m.Table, m.Id)] = true
+	}
+}
+
+// ids 過濾 upsertID 一行的 id
+func (f Filter) ids(table string, ids []string) []string {
+
+	if f.Empty() {
+		return ids
+	}
+
+	kept := []string{}
+	for _, id := range ids {
+		if f.record(table, id) {
+			kept = append(kept, id)
+		}
+	}
+
+	return kept
+}
+
+// match 讀取 originData，記錄原資料符合 Where 的 (table, id)，讀取後將檔案移回開頭
+func (f *Filter) match(oReader io.ReadSeeker) error {
+
+	if len(f.Where) == 0 {
+		return nil
+	}
+
+	f.matched = map[string]bool{}
+	reader := bufio.NewReader(oReader)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			bo, parseErr := backup.ParseRecord(line)
+			if parseErr != nil {
+				log.Printf("Backup record error: %+v", parseErr)
+				return parseErr
+			}
+
+			var obj map[string]interface{}
+			if json.Unmarshal([]byte(bo.Data), &obj) == nil && transform.Match(f.Where, obj) {
+				f.matched[key(bo.Table, bo.Id)] = true
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Print(err)
+			return err
+		}
+	}
+
+	_, err := oReader.Seek(0, io.SeekStart)
+
+	return err
+}
@@ -0,0 +1,141 @@
+package recover
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/meepshop/go-db-migration/pkg/backup"
+)
+
+func TestNewFilter(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "recover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	idsFile := filepath.Join(dir, "ids.txt")
+	if err := ioutil.WriteFile(idsFile, []byte("a\n\n b \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		tables  string
+		ids     string
+		idsFile string
+		where   string
+		str     string
+		empty   bool
+		err     bool
+	}{
+		{name: "empty", empty: true},
+		{name: "tables and ids", tables: "orders, users,", ids: "c,a", str: "tables=orders,users ids=a,c"},
+		{name: "ids file", ids: "c", idsFile: idsFile, str: "ids=a,b,c"},
+		{name: "where", where: "[{path: status, op: eq, value: 1}]", str: `where=[{"path":"status","op":"eq","value":1}]`},
+		{name: "missing ids file", idsFile: filepath.Join(dir, "none"), err: true},
+		{name: "unknown where op", where: "[{path: status, op: gt, value: 1}]", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f, err := NewFilter(tt.tables, tt.ids, tt.idsFile, tt.where)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Empty() != tt.empty {
+				t.Errorf("Empty() = %v, want %v", f.Empty(), tt.empty)
+			}
+			if f.String() != tt.str {
+				t.Errorf("String() = %q, want %q", f.String(), tt.str)
+			}
+		})
+	}
+}
+
+func TestFilterRecord(t *testing.T) {
+
+	origin := backup.FormatRecord("orders", "o1", "", `{"status": 1}`, "", "") +
+		backup.FormatRecord("orders", "o2", "", `{"status": 2}`, "", "") +
+		backup.FormatRecord("users", "o1", "", `{"status": 1}`, "", "")
+
+	tests := []struct {
+		name     string
+		tables   string
+		ids      string
+		where    string
+		modified []Modified
+		records  map[string]bool
+		kept     []string
+	}{
+		{
+			name:    "no filter",
+			records: map[string]bool{"orders o1": true, "orders o2": true, "orders o3": true, "users o1": true},
+			kept:    []string{"o1", "o2", "o3"},
+		},
+		{
+			name:    "table",
+			tables:  "users",
+			records: map[string]bool{"orders o1": false, "users o1": true},
+			kept:    []string{},
+		},
+		{
+			name:    "ids",
+			ids:     "o2,o3",
+			records: map[string]bool{"orders o1": false, "orders o2": true, "users o3": true},
+			kept:    []string{"o2", "o3"},
+		},
+		{
+			name:    "where matches the original data only",
+			where:   "[{path: status, op: eq, value: 1}]",
+			records: map[string]bool{"orders o1": true, "orders o2": false, "orders o3": false, "users o1": true},
+			kept:    []string{"o1"},
+		},
+		{
+			name:     "excluded conflicts",
+			modified: []Modified{{Table: "orders", Id: "o2"}},
+			records:  map[string]bool{"orders o1": true, "orders o2": false, "users o2": true},
+			kept:     []string{"o1", "o3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f, err := NewFilter(tt.tables, tt.ids, "", tt.where)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader := strings.NewReader(origin)
+			if err := f.match(reader); err != nil {
+				t.Fatal(err)
+			}
+			if pos, _ := reader.Seek(0, 1); pos != 0 {
+				t.Errorf("match should seek back to the start, at %d", pos)
+			}
+			f.exclude(tt.modified)
+
+			for record, want := range tt.records {
+				parts := strings.Split(record, " ")
+				if got := f.record(parts[0], parts[1]); got != want {
+					t.Errorf("record(%s, %s) = %v, want %v", parts[0], parts[1], got, want)
+				}
+			}
+			if got := f.ids("orders", []string{"o1", "o2", "o3"}); !reflect.DeepEqual(got, tt.kept) {
+				t.Errorf("ids = %v, want %v", got, tt.kept)
+			}
+		})
+	}
+}
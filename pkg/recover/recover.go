@@ -9,11 +9,16 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	_ "github.com/lib/pq"
+	"github.com/meepshop/go-db-migration/pkg/backup"
 	"github.com/meepshop/go-db-migration/pkg/database"
+	"github.com/meepshop/go-db-migration/pkg/history"
+	"github.com/meepshop/go-db-migration/pkg/lock"
+	"github.com/meepshop/go-db-migration/pkg/logger"
 	"github.com/meepshop/go-db-migration/pkg/utils"
 	elastic "gopkg.in/olivere/elastic.v5"
 )
@@ -24,6 +29,22 @@ type Recover struct {
 	oFile       *os.File
 	uFile       *os.File
 	curTimeNano int64
+
+	id      string
+	runId   string
+	started time.Time
+	locker  *lock.Locker
+
+	// Lock advisory lock 的範圍：table、global 或 none，空值同 none
+	Lock string
+	// LockWait lock 被其他執行持有時最長的等待時間，0 時直接失敗
+	LockWait time.Duration
+	// Filter 只還原符合條件的資料
+	Filter Filter
+	// DryRun 只列出會變更的資料
+	DryRun bool
+	// OnConflict migration 之後又被修改的資料的處理方式：report、skip 或 force，空值同 report
+	OnConflict string
 }
 
 type DeleteIDs struct {
@@ -31,17 +52,19 @@ type DeleteIDs struct {
 	IDs   string
 }
 
-type BackupOrigin struct {
-	Table  string
-	Id     string
-	Parent string
-	Data   string
-}
+type BackupOrigin = backup.Record
 
-func NewRecover(backup string) (Recover, error) {
+func NewRecover(id string) (Recover, error) {
 
-	r := Recover{}
-	r.curTimeNano = time.Now().UnixNano()
+	r := Recover{id: id}
+	r.started = time.Now()
+	r.runId = utils.NewRunId(r.started)
+	r.curTimeNano = utils.RunIdVersion(r.runId)
+
+	// 接受 run ID 或舊版的時間字串
+	if !utils.IsRunId(id) {
+		return r, errors.New("invalid backup id: " + id)
+	}
 
 	pg, err := database.NewPGConn()
 	if err != nil {
@@ -55,14 +78,24 @@ func NewRecover(backup string) (Recover, error) {
 	}
 	r.es = es
 
-	oFile, err := os.Open("backup/" + backup + "_originData")
+	logger.SetRunID(r.runId)
+	log.Printf("Recover %s as %s\n", id, r.runId)
+
+	if err := utils.LoadTableConfig(os.Getenv("TABLE_CONFIG")); err != nil {
+		return r, err
+	}
+	if err := utils.ValidateTableConfig(r.db, r.es); err != nil {
+		return r, err
+	}
+
+	oFile, err := os.Open(filepath.Join(backup.Dir, id+backup.OriginSuffix))
 	if err != nil {
 		log.Printf("%+v", err)
 		return r, err
 	}
 	r.oFile = oFile
 
-	uFile, err := os.Open("backup/" + backup + "_upsertID")
+	uFile, err := os.Open(filepath.Join(backup.Dir, id+backup.UpsertSuffix))
 	if err != nil {
 		log.Printf("%+v", err)
 		return r, err
@@ -72,35 +105,159 @@ func NewRecover(backup string) (Recover, error) {
 	return r, nil
 }
 
-func (r *Recover) ProcRecover() error {
+// ProcRecover 還原備份，執行記錄寫入 migration_runs
+func (r *Recover) ProcRecover() (err error) {
+
+	switch r.OnConflict {
+	case "", OnConflictReport, OnConflictSkip, OnConflictForce:
+	default:
+		return errors.New("unknown conflict policy: " + r.OnConflict)
+	}
+
+	if err := r.Filter.match(r.oFile); err != nil {
+		return err
+	}
+
+	// dry-run 不寫入 migration_runs 也不取得 lock
+	if r.DryRun {
+		return r.plan()
+	}
+
+	if err := history.Start(r.db, history.Run{
+		RunId:     r.runId,
+		StartedAt: r.started,
+		Operator:  history.Operator(),
+		Host:      history.Host(),
+		Command:   "recover",
+		Query:     r.Filter.String(),
+		Backup:    filepath.Join(backup.Dir, r.id),
+	}); err != nil {
+		return err
+	}
+	defer func() {
+		status, errMsg := "completed", ""
+		if err != nil {
+			status, errMsg = "failed", err.Error()
+		}
+		history.Finish(r.db, r.runId, status, errMsg, nil)
+	}()
+
+	if err := r.lockTables(); err != nil {
+		return err
+	}
+
+	return r.recover()
+}
+
+// lockTables 還原前先取得備份內所有 table 的 lock
+func (r *Recover) lockTables() error {
 
-	// 先讀取upsertID 把所有變更過的資料刪除
-	uScanner := bufio.NewScanner(r.uFile)
-	uScanner.Split(bufio.ScanLines)
+	mode := r.Lock
+	if mode == "" {
+		mode = lock.ModeNone
+	}
+
+	ctx := context.Background()
+	locker, err := lock.New(ctx, r.db, mode, r.LockWait, r.runId)
+	if err != nil || locker == nil {
+		return err
+	}
+	r.locker = locker
+
+	tables, err := r.backupTables()
+	if err != nil {
+		return err
+	}
+
+	return locker.Tables(ctx, tables)
+}
+
+// backupTables 備份檔內出現的 table，讀取後將檔案移回開頭
+func (r *Recover) backupTables() ([]string, error) {
+
+	seen := map[string]bool{}
+	tables := []string{}
+	add := func(table string) {
+		if !seen[table] {
+			seen[table] = true
+			tables = append(tables, table)
+		}
+	}
+
+	uReader := bufio.NewReader(r.uFile)
+	for i := 0; ; i++ {
+		line, err := uReader.ReadString('\n')
+		if table := strings.TrimRight(line, "\n"); table != "" && i%2 == 0 && r.Filter.table(table) {
+			add(table)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Print(err)
+			return nil, err
+		}
+	}
 
-	curTable := ""
-	curTableRow := true
-	allDeleteIDs := [][]string{}
-	for uScanner.Scan() {
+	oReader := bufio.NewReader(r.oFile)
+	for {
+		line, err := oReader.ReadString('\n')
+		if line != "" {
+			if rec, err := backup.ParseRecord(line); err == nil && r.Filter.table(rec.Table) {
+				add(rec.Table)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Print(err)
+			return nil, err
+		}
+	}
 
-		if curTableRow {
-			curTable = uScanner.Text()
-			curTableRow = false
-		} else {
-			delIDs := []string{curTable, uScanner.Text()}
-			allDeleteIDs = append(allDeleteIDs, delIDs)
-			curTableRow = true
+	for _, f := range []*os.File{r.uFile, r.oFile} {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			log.Print(err)
+			return nil, err
 		}
 	}
 
-	err := r.doDelete(allDeleteIDs)
+	return tables, nil
+}
+
+func (r *Recover) recover() error {
+
+	// 先讀取upsertID 把所有變更過的資料刪除，有條件時只刪除符合的 id
+	allDeleteIDs, err := r.readChanges()
+	if err != nil {
+		return err
+	}
+
+	// migration 之後又被修改的資料依 OnConflict 處理
+	modified, err := r.modified(allDeleteIDs)
+	if err != nil {
+		return err
+	}
+	if allDeleteIDs, err = r.resolve(allDeleteIDs, modified); err != nil {
+		return err
+	}
+
+	err = r.doDelete(allDeleteIDs)
 	if err != nil {
 		return err
 	}
 
 	// 再讀取originData 將原資料寫回
+	return r.readOrigins(r.oFile, r.doInsert)
+}
+
+// readOrigins 每 100 筆原資料交給 fn 寫回，同一個 (table, id) 只取第一筆，
+// 舊版備份同一個 id 跨批次時會重複記錄，之後的記錄是 migration 寫入的結果而非原資料
+func (r *Recover) readOrigins(oFile io.Reader, fn func(originDatas map[string][]BackupOrigin) error) error {
+
+	seen := map[string]bool{}
 	originDatas := map[string][]BackupOrigin{}
-	oReader := bufio.NewReader(r.oFile)
+	count := 0
+	oReader := bufio.NewReader(oFile)
 	for {
 		line, err := oReader.ReadString('\n')
 		if err == io.EOF {
@@ -110,26 +267,28 @@ func (r *Recover) ProcRecover() error {
 			return err
 		}
 
-		o := strings.Split(line, "!@#")
-		originDatas[o[0]] = append(originDatas[o[0]], BackupOrigin{
-			Table:  o[0],
-			Id:     o[1],
-			Parent: o[2],
-			Data:   o[3],
-		})
+		bo, err := backup.ParseRecord(line)
+		if err != nil {
+			log.Printf("Backup record error: %+v", err)
+			return err
+		}
+		if !r.Filter.Empty() && !r.Filter.record(bo.Table, bo.Id) {
+			continue
+		}
+		if seen[key(bo.Table, bo.Id)] {
+			continue
+		}
+		seen[key(bo.Table, bo.Id)] = true
+		originDatas[bo.Table] = append(originDatas[bo.Table], bo)
 
-		if len(originDatas) == 100 {
-			if err := r.doInsert(originDatas); err != nil {
+		if count += 1; count == 100 {
+			if err := fn(originDatas); err != nil {
 				return err
 			}
 
 			originDatas = map[string][]BackupOrigin{}
+			count = 0
 		}
-
-	}
-
-	if err := r.doInsert(originDatas); err != nil {
-		return err
 	}
 
 	/*
@@ -165,7 +324,8 @@ func (r *Recover) ProcRecover() error {
 			return err
 		}
 	*/
-	return nil
+
+	return fn(originDatas)
 }
 
 func (r *Recover) doInsert(originDatas map[string][]BackupOrigin) error {
@@ -174,29 +334,37 @@ func (r *Recover) doInsert(originDatas map[string][]BackupOrigin) error {
 
 	for table, oDatas := range originDatas {
 
-		esTable := utils.PgEsTableMapping[table]
-		if esTable == "" {
-			esTable = table
-		}
+		tc := utils.GetTableConfig(table)
 
 		var values []string
-		bulk := r.es.Bulk().Index(os.Getenv("ELASTIC_DB")).Type(esTable)
+		bulk := r.es.Bulk().Index(tc.EsIndex).Type(tc.EsType)
 
 		for _, oData := range oDatas {
-			// escape '
-			ecoData := strings.Replace(oData.Data, "'", "''", -1)
-			values = append(values, fmt.Sprintf("('%s', '%s')", oData.Id, ecoData))
-			bulk.Add(elastic.NewBulkIndexRequest().Id(oData.Id).VersionType("external").Version(r.curTimeNano).Parent(oData.Parent).Doc(oData.Data))
+			values = append(values, tc.InsertValues(oData.Id, oData.Data, oData.Columns))
+
+			doc := oData.Data
+			if oData.EsBackup {
+				if oData.EsData == "" {
+					continue
+				}
+				doc = oData.EsData
+			}
+			bulk.Add(elastic.NewBulkIndexRequest().Id(oData.Id).VersionType("external").Version(r.curTimeNano).Parent(oData.Parent).Routing(tc.Routing(oData.Data)).Doc(doc))
 		}
 
 		// PG Insert
-		upsSql := fmt.Sprintf("INSERT INTO %s (id, data) VALUES %s", table, strings.Join(values, ","))
+		upsSql := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", table, tc.InsertColumns(), strings.Join(values, ","))
 		_, err := r.db.Exec(upsSql)
 		if err != nil {
 			log.Printf("PG Insert error: %+v", err)
 			return err
 		}
 
+		// 不需同步ES的table 略過
+		if !tc.Synced() || bulk.NumberOfActions() == 0 {
+			continue
+		}
+
 		// ES Bulk Do
 		res, err := bulk.Do(ctx)
 		if err != nil {
@@ -224,24 +392,48 @@ func (r *Recover) doDelete(allDeleteIDs [][]string) error {
 
 	for _, delIDs := range allDeleteIDs {
 
-		esTable := utils.PgEsTableMapping[delIDs[0]]
-		if esTable == "" {
-			esTable = delIDs[0]
-		}
+		tc := utils.GetTableConfig(delIDs[0])
 
-		bulk := r.es.Bulk().Index(os.Getenv("ELASTIC_DB")).Type(esTable)
+		bulk := r.es.Bulk().Index(tc.EsIndex).Type(tc.EsType)
 
 		idArr := strings.Split(delIDs[1], ",")
-		delSql := fmt.Sprintf("DELETE FROM %s WHERE id IN ('%s')", delIDs[0], strings.Join(idArr, "','"))
 
-		_, err := r.db.Exec(delSql)
+		// 刪除前先取得目前資料的 parent 及 routing
+		query := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s IN ('%s')", tc.IdIdent(), tc.DataIdent(), delIDs[0], tc.IdIdent(), strings.Join(idArr, "','"))
+		rows, err := r.db.Query(query)
 		if err != nil {
-			log.Printf("doRecover pg exec error: %+v", err)
+			log.Printf("doRecover pg query error: %+v", err)
 			return err
 		}
 
+		currentDatas := map[string]string{}
+		for rows.Next() {
+			var id, data string
+			if err := rows.Scan(&id, &data); err != nil {
+				rows.Close()
+				log.Printf("doRecover pg scan error: %+v", err)
+				return err
+			}
+			currentDatas[id] = data
+		}
+		rows.Close()
+
 		for _, id := range idArr {
-			bulk.Add(elastic.NewBulkDeleteRequest().Id(id))
+			data := currentDatas[id]
+			bulk.Add(elastic.NewBulkDeleteRequest().Id(id).Parent(tc.Parent(data)).Routing(tc.Routing(data)))
+		}
+
+		delSql := fmt.Sprintf("DELETE FROM %s WHERE %s IN ('%s')", delIDs[0], tc.IdIdent(), strings.Join(idArr, "','"))
+
+		_, err = r.db.Exec(delSql)
+		if err != nil {
+			log.Printf("doRecover pg exec error: %+v", err)
+			return err
+		}
+
+		// 不需同步ES的table 略過
+		if !tc.Synced() {
+			continue
 		}
 
 		// ES 批次執行
@@ -264,6 +456,8 @@ func (r *Recover) doDelete(allDeleteIDs [][]string) error {
 
 func (r *Recover) Close() {
 
+	r.locker.Close()
+
 	if r.db != nil {
 		r.db.Close()
 	}
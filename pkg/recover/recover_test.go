@@ -0,0 +1,90 @@
+package recover
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/meepshop/go-db-migration/pkg/backup"
+)
+
+func TestReadOrigins(t *testing.T) {
+
+	// 舊版備份：pluginExample 的 UPSERT 與 DELETE 分成兩個批次，c1 記錄了兩次
+	pair := backup.FormatRecord("activitycouponcode", "c1", "", `{"id": "c1"}`, "", "") +
+		backup.FormatRecord("activitycouponcode", "c1", "", `{"id": "c1", "updatedAt": "2017-12-25T00:00:00.000000+00:00"}`, "", "")
+
+	many := ""
+	for i := 0; i < 150; i++ {
+		many += backup.FormatRecord("orders", fmt.Sprintf("o%d", i), "", `{}`, "", "")
+	}
+
+	tests := []struct {
+		name   string
+		origin string
+		ids    string
+		want   []int
+		data   map[string]string
+	}{
+		{
+			name:   "first origin wins",
+			origin: pair,
+			want:   []int{1},
+			data:   map[string]string{"c1": `{"id": "c1"}`},
+		},
+		{
+			name:   "same id in other table is kept",
+			origin: pair + backup.FormatRecord("orders", "c1", "", `{"id": "o"}`, "", ""),
+			want:   []int{2},
+		},
+		{
+			name:   "filtered",
+			origin: pair,
+			ids:    "c2",
+			want:   []int{0},
+		},
+		{
+			name:   "every 100 records",
+			origin: many,
+			want:   []int{100, 50},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f, err := NewFilter("", tt.ids, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &Recover{Filter: f}
+
+			sizes := []int{}
+			data := map[string]string{}
+			err = r.readOrigins(strings.NewReader(tt.origin), func(originDatas map[string][]BackupOrigin) error {
+				n := 0
+				for _, oDatas := range originDatas {
+					for _, oData := range oDatas {
+						data[oData.Id] = oData.Data
+						n += 1
+					}
+				}
+				sizes = append(sizes, n)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(sizes, tt.want) {
+				t.Errorf("sizes = %v, want %v", sizes, tt.want)
+			}
+			for id, want := range tt.data {
+				if data[id] != want {
+					t.Errorf("data of %s = %s, want %s", id, data[id], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,456 @@
+package rpcPlugin
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+)
+
+// ProtocolVersion plugin 協定版本，handshake 時雙方需一致
+const ProtocolVersion = 1
+
+var errExited = errors.New("plugin exited")
+
+// Plugin 常駐的外部 plugin，以每行一筆 JSON-RPC 2.0 訊息透過 stdin/stdout 溝通：
+//
+//	host → plugin  {"jsonrpc":"2.0","id":1,"method":"handshake","params":{"protocol":1,"capabilities":["lookup"]}}
+//	plugin → host  {"jsonrpc":"2.0","id":1,"result":{"protocol":1,"capabilities":[]}}
+//	host → plugin  {"jsonrpc":"2.0","id":2,"method":"migration","params":{"id":"...","data":"{...}","version":"..."}}
+//	plugin → host  {"jsonrpc":"2.0","id":2,"result":[MigrationData...]} 或 {"jsonrpc":"2.0","id":2,"error":{"code":1,"message":"..."}}
+//	plugin → host  {"jsonrpc":"2.0","id":"l1","method":"lookup","params":{"query":"SELECT ...","args":[...]}}
+//	host → plugin  {"jsonrpc":"2.0","id":"l1","result":[{"column":"value"}]}
+//
+// plugin 逾時未回應視為卡住，會重新啟動；plugin 中途結束時會重新啟動並重送一次．
+type Plugin struct {
+	command []string
+	timeout time.Duration
+	db      *sql.DB
+
+	mu     sync.Mutex
+	proc   *process
+	nextId int64
+}
+
+type message struct {
+	JsonRPC string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// RPCError plugin 回報的錯誤
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("plugin error %d: %s", e.Code, e.Message)
+}
+
+type handshake struct {
+	Protocol     int      `json:"protocol"`
+	Capabilities []string `json:"capabilities"`
+}
+
+type lookupParams struct {
+	Query string        `json:"query"`
+	Args  []interface{} `json:"args"`
+}
+
+// Load 啟動 plugin 並完成 handshake，db 供 plugin 的 lookup 使用，可為 nil
+func Load(command string, timeout time.Duration, db *sql.DB) (*Plugin, error) {
+
+	p := &Plugin{command: strings.Fields(command), timeout: timeout, db: db}
+	if len(p.command) == 0 {
+		return nil, errors.New("plugin command is empty")
+	}
+
+	if _, err := p.process(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Transform 實作 transformer.Transformer，可同時由多個 goroutine 呼叫
+func (p *Plugin) Transform(ctx context.Context, row dbMigration.Row) ([]dbMigration.MigrationData, error) {
+
+	params := map[string]string{"id": row.Id, "data": row.Data, "version": row.Version}
+
+	for attempt := 0; ; attempt++ {
+
+		proc, err := p.process()
+		if err != nil {
+			return nil, err
+		}
+
+		callCtx := ctx
+		cancel := func() {}
+		if p.timeout > 0 {
+			callCtx, cancel = context.WithTimeout(ctx, p.timeout)
+		}
+		res, err := proc.call(callCtx, atomic.AddInt64(&p.nextId, 1), "migration", params)
+		timedOut := callCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+
+		switch {
+		case err == nil:
+			var mDatas []dbMigration.MigrationData
+			if err := json.Unmarshal(res, &mDatas); err != nil {
+				return nil, fmt.Errorf("unmarshal plugin result ID: %s: %v", row.Id, err)
+			}
+			return mDatas, nil
+		case timedOut:
+			log.Printf("Plugin hang ID: %s, restarting\n", row.Id)
+			p.restart(proc)
+			return nil, fmt.Errorf("plugin timeout ID: %s", row.Id)
+		case err == errExited:
+			log.Printf("Plugin exited ID: %s, restarting\n", row.Id)
+			p.restart(proc)
+			if attempt > 0 {
+				return nil, fmt.Errorf("plugin exited ID: %s", row.Id)
+			}
+		default:
+			return nil, err
+		}
+	}
+}
+
+// Close 關閉 plugin 的 stdin 並等待結束
+func (p *Plugin) Close() {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.proc != nil {
+		p.proc.close()
+		p.proc = nil
+	}
+}
+
+// process 取得執行中的 plugin，尚未啟動時啟動並 handshake
+func (p *Plugin) process() (*process, error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.proc != nil {
+		return p.proc, nil
+	}
+
+	proc, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	p.proc = proc
+
+	return proc, nil
+}
+
+func (p *Plugin) restart(proc *process) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.proc == proc {
+		proc.kill()
+		p.proc = nil
+	}
+}
+
+func (p *Plugin) start() (*process, error) {
+
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("Start plugin error: %+v", err)
+		return nil, err
+	}
+
+	proc := &process{
+		plugin:  p,
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: map[string]chan message{},
+		done:    make(chan struct{}),
+	}
+	go proc.read(stdout)
+
+	ctx := context.Background()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	res, err := proc.call(ctx, atomic.AddInt64(&p.nextId, 1), "handshake", handshake{Protocol: ProtocolVersion, Capabilities: []string{"lookup"}})
+	if err != nil {
+		proc.kill()
+		log.Printf("Plugin handshake error: %+v", err)
+		return nil, err
+	}
+
+	hs := handshake{}
+	if err := json.Unmarshal(res, &hs); err != nil || hs.Protocol != ProtocolVersion {
+		proc.kill()
+		log.Printf("Plugin handshake error: unsupported protocol %s\n", string(res))
+		return nil, errors.New("unsupported plugin protocol")
+	}
+
+	return proc, nil
+}
+
+type process struct {
+	plugin *Plugin
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	pending map[string]chan message
+	done    chan struct{}
+}
+
+func (proc *process) call(ctx context.Context, id int64, method string, params interface{}) (json.RawMessage, error) {
+
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprint(id)
+	ch := make(chan message, 1)
+	proc.mu.Lock()
+	proc.pending[key] = ch
+	proc.mu.Unlock()
+	defer func() {
+		proc.mu.Lock()
+		delete(proc.pending, key)
+		proc.mu.Unlock()
+	}()
+
+	if err := proc.write(message{JsonRPC: "2.0", Id: json.RawMessage(key), Method: method, Params: b}); err != nil {
+		return nil, errExited
+	}
+
+	select {
+	case msg := <-ch:
+		return msg.result()
+	case <-proc.done:
+		// 結束前送出的回應仍有效
+		select {
+		case msg := <-ch:
+			return msg.result()
+		default:
+			return nil, errExited
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (msg message) result() (json.RawMessage, error) {
+
+	if msg.Error != nil {
+		return nil, msg.Error
+	}
+
+	return msg.Result, nil
+}
+
+func (proc *process) write(msg message) error {
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	proc.writeMu.Lock()
+	defer proc.writeMu.Unlock()
+
+	_, err = proc.stdin.Write(append(b, '\n'))
+	return err
+}
+
+// read 讀取 plugin 的輸出，回應交給對應的 call，lookup 請求另外處理
+func (proc *process) read(stdout io.Reader) {
+
+	defer close(proc.done)
+
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			msg := message{}
+			if jsonErr := json.Unmarshal(line, &msg); jsonErr != nil {
+				log.Printf("Plugin output is not a protocol message: %s\n", strings.TrimSpace(string(line)))
+			} else if msg.Method != "" {
+				go proc.handle(msg)
+			} else {
+				proc.mu.Lock()
+				ch := proc.pending[idKey(msg.Id)]
+				proc.mu.Unlock()
+				if ch != nil {
+					ch <- msg
+				}
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Read plugin error: %+v", err)
+			}
+			return
+		}
+	}
+}
+
+// idKey 回應的 id 可為數字或字串，"2" 與 2 對應同一個請求
+func idKey(id json.RawMessage) string {
+
+	var s string
+	if json.Unmarshal(id, &s) == nil {
+		return s
+	}
+
+	return strings.TrimSpace(string(id))
+}
+
+// handle 處理 plugin 發出的請求
+func (proc *process) handle(msg message) {
+
+	reply := message{JsonRPC: "2.0", Id: msg.Id}
+
+	switch msg.Method {
+	case "lookup":
+		params := lookupParams{}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			reply.Error = &RPCError{Code: -32602, Message: err.Error()}
+			break
+		}
+
+		rows, err := proc.plugin.lookup(params)
+		if err != nil {
+			reply.Error = &RPCError{Code: 1, Message: err.Error()}
+			break
+		}
+		reply.Result, _ = json.Marshal(rows)
+	default:
+		reply.Error = &RPCError{Code: -32601, Message: "method not found: " + msg.Method}
+	}
+
+	if err := proc.write(reply); err != nil {
+		log.Printf("Reply plugin error: %+v", err)
+	}
+}
+
+// lookup 供 plugin 查詢其他資料，僅允許 SELECT；
+// 於唯讀的 transaction 內以 prepared statement 執行，避免以多個 statement 寫入
+func (p *Plugin) lookup(params lookupParams) ([]map[string]interface{}, error) {
+
+	if p.db == nil {
+		return nil, errors.New("lookup is not available")
+	}
+	if !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(params.Query)), "SELECT") {
+		return nil, errors.New("lookup only allows SELECT")
+	}
+
+	ctx := context.Background()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	tx, err := p.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// prepared statement 不允許一次執行多個 statement
+	stmt, err := tx.PrepareContext(ctx, params.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, params.Args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+
+		result := map[string]interface{}{}
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			result[column] = values[i]
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+func (proc *process) kill() {
+
+	if proc.cmd.Process != nil {
+		proc.cmd.Process.Kill()
+	}
+	proc.cmd.Wait()
+}
+
+func (proc *process) close() {
+
+	proc.stdin.Close()
+
+	select {
+	case <-proc.done:
+		proc.cmd.Wait()
+	case <-time.After(5 * time.Second):
+		proc.kill()
+	}
+}
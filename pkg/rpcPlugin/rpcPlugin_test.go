@@ -0,0 +1,203 @@
+package rpcPlugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+)
+
+// TestHelperPlugin 以測試執行檔作為 plugin，依 row 的 data 決定行為：
+//
+//	hang        不回應
+//	crash       直接結束
+//	crash-once  第一次結束，重新啟動後正常回應
+//	slow        延遲回應，讓其他請求先回應
+//
+// PLUGIN_STRING_ID 不為空時以字串回傳 id
+func TestHelperPlugin(t *testing.T) {
+
+	if os.Getenv("GO_WANT_HELPER_PLUGIN") != "1" {
+		return
+	}
+
+	var mu sync.Mutex
+	out := json.NewEncoder(os.Stdout)
+	reply := func(id json.RawMessage, result interface{}) {
+		if os.Getenv("PLUGIN_STRING_ID") != "" {
+			var n json.Number
+			if json.Unmarshal(id, &n) == nil {
+				id, _ = json.Marshal(n.String())
+			}
+		}
+		b, _ := json.Marshal(result)
+		mu.Lock()
+		defer mu.Unlock()
+		out.Encode(message{JsonRPC: "2.0", Id: id, Result: b})
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		msg := message{}
+		json.Unmarshal(scanner.Bytes(), &msg)
+
+		if msg.Method == "handshake" {
+			reply(msg.Id, handshake{Protocol: ProtocolVersion})
+			continue
+		}
+
+		params := map[string]string{}
+		json.Unmarshal(msg.Params, &params)
+		result := []dbMigration.MigrationData{{Table: "t", Action: "UPSERT", Id: params["id"], Data: params["data"]}}
+
+		switch params["data"] {
+		case "hang":
+		case "crash":
+			os.Exit(1)
+		case "crash-once":
+			marker := os.Getenv("PLUGIN_MARKER")
+			if _, err := os.Stat(marker); err != nil {
+				ioutil.WriteFile(marker, nil, 0644)
+				os.Exit(1)
+			}
+			reply(msg.Id, result)
+		case "slow":
+			go func(id json.RawMessage) {
+				time.Sleep(200 * time.Millisecond)
+				reply(id, result)
+			}(msg.Id)
+		default:
+			reply(msg.Id, result)
+		}
+	}
+	os.Exit(0)
+}
+
+func load(t *testing.T, stringId bool) *Plugin {
+
+	dir, err := ioutil.TempDir("", "rpcPlugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	os.Setenv("GO_WANT_HELPER_PLUGIN", "1")
+	os.Setenv("PLUGIN_MARKER", filepath.Join(dir, "crashed"))
+	if stringId {
+		os.Setenv("PLUGIN_STRING_ID", "1")
+	} else {
+		os.Unsetenv("PLUGIN_STRING_ID")
+	}
+	t.Cleanup(func() {
+		os.Unsetenv("GO_WANT_HELPER_PLUGIN")
+		os.Unsetenv("PLUGIN_MARKER")
+		os.Unsetenv("PLUGIN_STRING_ID")
+	})
+
+	p, err := Load(os.Args[0]+" -test.run=^TestHelperPlugin$", 500*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func TestTransform(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		data     string
+		stringId bool
+		err      string
+	}{
+		{name: "ok", data: "{}"},
+		{name: "string id", data: "{}", stringId: true},
+		{name: "timeout restarts", data: "hang", err: "plugin timeout"},
+		{name: "crash restarts and resends once", data: "crash-once"},
+		{name: "crash twice", data: "crash", err: "plugin exited"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			p := load(t, tt.stringId)
+
+			mDatas, err := p.Transform(context.Background(), dbMigration.Row{Id: "1", Data: tt.data})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if len(mDatas) != 1 || mDatas[0].Id != "1" || mDatas[0].Data != tt.data {
+				t.Fatalf("Transform = %+v", mDatas)
+			}
+
+			// 重新啟動後下一筆仍可執行
+			mDatas, err = p.Transform(context.Background(), dbMigration.Row{Id: "2", Data: "{}"})
+			if err != nil {
+				t.Fatalf("Transform after %s: %v", tt.name, err)
+			}
+			if len(mDatas) != 1 || mDatas[0].Id != "2" {
+				t.Fatalf("Transform after %s = %+v", tt.name, mDatas)
+			}
+		})
+	}
+}
+
+func TestTransformMatchesId(t *testing.T) {
+
+	for _, stringId := range []bool{false, true} {
+		t.Run(fmt.Sprintf("string id %v", stringId), func(t *testing.T) {
+
+			p := load(t, stringId)
+
+			// slow 較晚回應，每個請求仍需取得自己的結果
+			rows := []dbMigration.Row{{Id: "slow", Data: "slow"}, {Id: "a", Data: "{}"}, {Id: "b", Data: "{}"}}
+			errs := make(chan error, len(rows))
+			for _, row := range rows {
+				go func(row dbMigration.Row) {
+					mDatas, err := p.Transform(context.Background(), row)
+					if err == nil && (len(mDatas) != 1 || mDatas[0].Id != row.Id) {
+						err = fmt.Errorf("row %s got %+v", row.Id, mDatas)
+					}
+					errs <- err
+				}(row)
+			}
+			for range rows {
+				if err := <-errs; err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestIdKey(t *testing.T) {
+
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{`2`, "2"},
+		{`"2"`, "2"},
+		{` 2 `, "2"},
+		{`"l1"`, "l1"},
+	}
+
+	for _, tt := range tests {
+		if got := idKey(json.RawMessage(tt.id)); got != tt.want {
+			t.Errorf("idKey(%s) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package throttle
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// 速度因子的下限，避免完全停止
+const minFactor = 0.05
+
+// 複製延遲的檢查間隔
+const lagInterval = 5 * time.Second
+
+// Limits 寫入速度限制，0 表示不限制
+type Limits struct {
+	RecordsPerSec float64 `json:"recordsPerSec" yaml:"recordsPerSec"`
+	BatchesPerSec float64 `json:"batchesPerSec" yaml:"batchesPerSec"`
+
+	// 超過時降低速度，單位為毫秒
+	MaxBulkLatencyMs    int64 `json:"maxBulkLatencyMs" yaml:"maxBulkLatencyMs"`
+	MaxReplicationLagMs int64 `json:"maxReplicationLagMs" yaml:"maxReplicationLagMs"`
+}
+
+// Throttle 依 Limits 控制寫入速度，並在 ES 回應 429、bulk 變慢或 PG 複製延遲時自動降速，
+// 狀況恢復後逐步回到原本的速度．nil 的 Throttle 不做任何限制
+type Throttle struct {
+	mu     sync.Mutex
+	limits Limits
+	factor float64
+
+	nextRecord  time.Time
+	nextBatch   time.Time
+	lastLatency time.Duration
+
+	db        *sql.DB
+	lagAt     time.Time
+	file      string
+	fileMtime time.Time
+}
+
+// New 建立 Throttle，file 為控制檔，可在執行中修改 Limits，收到 SIGHUP 或檔案修改時重新讀取；
+// db 用於讀取 pg_stat_replication，可為 nil
+func New(limits Limits, file string, db *sql.DB) (*Throttle, error) {
+
+	t := &Throttle{limits: limits, factor: 1, file: file, db: db}
+	if file != "" {
+		if err := t.reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := t.reload(); err != nil {
+				log.Printf("Reload throttle error: %+v", err)
+			}
+		}
+	}()
+
+	return t, nil
+}
+
+// Limits 目前的速度限制
+func (t *Throttle) Limits() Limits {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.limits
+}
+
+// SetLimits 變更速度限制
+func (t *Throttle) SetLimits(limits Limits) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.limits = limits
+	log.Printf("Throttle limits: %+v\n", limits)
+}
+
+// WaitRecords 寫入 n 筆資料前等待
+func (t *Throttle) WaitRecords(n int) {
+
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	var wait time.Duration
+	if rate := t.limits.RecordsPerSec * t.factor; rate > 0 {
+		wait = reserve(&t.nextRecord, time.Duration(float64(n)/rate*float64(time.Second)))
+	}
+	t.mu.Unlock()
+
+	time.Sleep(wait)
+}
+
+// WaitBatch 寫入一個批次前等待，同時檢查控制檔與 PG 複製延遲
+func (t *Throttle) WaitBatch() {
+
+	if t == nil {
+		return
+	}
+
+	t.checkFile()
+	t.checkLag()
+
+	t.mu.Lock()
+	var wait time.Duration
+	if rate := t.limits.BatchesPerSec * t.factor; rate > 0 {
+		wait = reserve(&t.nextBatch, time.Duration(float64(time.Second)/rate))
+	} else if t.factor < 1 {
+		// 未限制批次速度時 依上次 bulk 耗時等比例暫停
+		wait = time.Duration(float64(t.lastLatency) * (1/t.factor - 1))
+	}
+	t.mu.Unlock()
+
+	time.Sleep(wait)
+}
+
+// ObserveBulk 回報 ES bulk 的耗時，超過 MaxBulkLatencyMs 時降速，否則逐步恢復
+func (t *Throttle) ObserveBulk(latency time.Duration) {
+
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastLatency = latency
+	if max := t.limits.MaxBulkLatencyMs; max > 0 && latency > time.Duration(max)*time.Millisecond {
+		t.slowDown("bulk latency " + latency.String())
+	} else {
+		t.speedUp()
+	}
+}
+
+// Backoff ES 拒絕寫入（429）時降速，回傳重試前應等待的時間
+func (t *Throttle) Backoff() time.Duration {
+
+	if t == nil {
+		return time.Second
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.slowDown("es rejected")
+
+	return time.Duration(float64(time.Second) / t.factor / 4)
+}
+
+// reserve 取得下一個可執行的時間，回傳需等待的時間
+func reserve(next *time.Time, cost time.Duration) time.Duration {
+
+	now := time.Now()
+	if next.Before(now) {
+		*next = now
+	}
+	wait := next.Sub(now)
+	*next = next.Add(cost)
+
+	return wait
+}
+
+func (t *Throttle) slowDown(reason string) {
+
+	t.factor /= 2
+	if t.factor < minFactor {
+		t.factor = minFactor
+	}
+	log.Printf("Throttle slow down to %.0f%%: %s\n", t.factor*100, reason)
+}
+
+func (t *Throttle) speedUp() {
+
+	if t.factor < 1 {
+		t.factor += 0.05
+		if t.factor > 1 {
+			t.factor = 1
+		}
+	}
+}
+
+// checkLag 定期讀取 pg_stat_replication，延遲超過 MaxReplicationLagMs 時降速並等待恢復
+func (t *Throttle) checkLag() {
+
+	for {
+		t.mu.Lock()
+		max := time.Duration(t.limits.MaxReplicationLagMs) * time.Millisecond
+		check := t.db != nil && max > 0 && time.Since(t.lagAt) >= lagInterval
+		if check {
+			t.lagAt = time.Now()
+		}
+		t.mu.Unlock()
+
+		if !check {
+			return
+		}
+
+		var seconds float64
+		err := t.db.QueryRow("SELECT COALESCE(EXTRACT(EPOCH FROM MAX(replay_lag)), 0) FROM pg_stat_replication").Scan(&seconds)
+		if err != nil {
+			log.Printf("Read replication lag error: %+v", err)
+			return
+		}
+
+		lag := time.Duration(seconds * float64(time.Second))
+		if lag <= max {
+			return
+		}
+
+		t.mu.Lock()
+		t.slowDown("replication lag " + lag.String())
+		t.mu.Unlock()
+		time.Sleep(lagInterval)
+	}
+}
+
+// checkFile 控制檔修改時重新讀取
+func (t *Throttle) checkFile() {
+
+	if t.file == "" {
+		return
+	}
+
+	info, err := os.Stat(t.file)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	changed := !info.ModTime().Equal(t.fileMtime)
+	t.mu.Unlock()
+
+	if changed {
+		if err := t.reload(); err != nil {
+			log.Printf("Reload throttle error: %+v", err)
+		}
+	}
+}
+
+// reload 讀取控制檔，YAML 或 JSON 格式，未填的欄位維持原設定
+func (t *Throttle) reload() error {
+
+	if t.file == "" {
+		return nil
+	}
+
+	info, err := os.Stat(t.file)
+	if err != nil {
+		log.Printf("Read throttle file error: %+v", err)
+		return err
+	}
+	b, err := ioutil.ReadFile(t.file)
+	if err != nil {
+		log.Printf("Read throttle file error: %+v", err)
+		return err
+	}
+
+	limits := t.Limits()
+	switch strings.ToLower(filepath.Ext(t.file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &limits)
+	default:
+		err = json.Unmarshal(b, &limits)
+	}
+	if err != nil {
+		log.Printf("Parse throttle file error: %+v", err)
+		return err
+	}
+
+	t.mu.Lock()
+	t.fileMtime = info.ModTime()
+	t.mu.Unlock()
+	t.SetLimits(limits)
+
+	return nil
+}
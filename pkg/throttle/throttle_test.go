@@ -0,0 +1,201 @@
+package throttle
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWaitRecords(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		limits Limits
+		calls  int
+		n      int
+		min    time.Duration
+	}{
+		// 第一次不需等待，之後每次等待 n / rate 秒
+		{"records per second", Limits{RecordsPerSec: 1000}, 3, 50, 100 * time.Millisecond},
+		{"unlimited", Limits{}, 3, 50, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			th, err := New(tt.limits, "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			for i := 0; i < tt.calls; i++ {
+				th.WaitRecords(tt.n)
+			}
+			elapsed := time.Since(start)
+			if elapsed < tt.min || elapsed > tt.min+500*time.Millisecond {
+				t.Errorf("elapsed %v, want about %v", elapsed, tt.min)
+			}
+		})
+	}
+}
+
+func TestReserve(t *testing.T) {
+
+	next := time.Time{}
+	if wait := reserve(&next, time.Second); wait != 0 {
+		t.Errorf("first reserve waits %v, want 0", wait)
+	}
+	if wait := reserve(&next, time.Second); wait < 900*time.Millisecond || wait > time.Second {
+		t.Errorf("second reserve waits %v, want about 1s", wait)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		rejected int
+		fast     int
+		wait     time.Duration
+		factor   float64
+	}{
+		{"first 429", 1, 0, 500 * time.Millisecond, 0.5},
+		{"repeated 429", 3, 0, 2 * time.Second, 0.125},
+		{"floor", 10, 0, 5 * time.Second, minFactor},
+		{"recovers after fast bulks", 1, 2, 500 * time.Millisecond, 0.6},
+		{"back to full speed", 1, 20, 500 * time.Millisecond, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			th, err := New(Limits{MaxBulkLatencyMs: 1000}, "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wait time.Duration
+			for i := 0; i < tt.rejected; i++ {
+				wait = th.Backoff()
+			}
+			for i := 0; i < tt.fast; i++ {
+				th.ObserveBulk(10 * time.Millisecond)
+			}
+
+			if wait != tt.wait {
+				t.Errorf("Backoff = %v, want %v", wait, tt.wait)
+			}
+			if diff := th.factor - tt.factor; diff > 1e-9 || diff < -1e-9 {
+				t.Errorf("factor = %v, want %v", th.factor, tt.factor)
+			}
+		})
+	}
+
+	var th *Throttle
+	if wait := th.Backoff(); wait != time.Second {
+		t.Errorf("nil Backoff = %v, want 1s", wait)
+	}
+}
+
+func TestObserveBulkSlow(t *testing.T) {
+
+	th, err := New(Limits{MaxBulkLatencyMs: 100}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	th.ObserveBulk(200 * time.Millisecond)
+	if th.factor != 0.5 {
+		t.Errorf("factor = %v, want 0.5", th.factor)
+	}
+}
+
+func TestReload(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		updated string
+		initial Limits
+		want    Limits
+		err     bool
+	}{
+		{
+			name:    "yaml",
+			file:    "throttle.yaml",
+			content: "recordsPerSec: 100\n",
+			updated: "recordsPerSec: 50\nbatchesPerSec: 2\n",
+			initial: Limits{MaxBulkLatencyMs: 1000},
+			want:    Limits{RecordsPerSec: 50, BatchesPerSec: 2, MaxBulkLatencyMs: 1000},
+		},
+		{
+			name:    "json",
+			file:    "throttle.json",
+			content: `{"recordsPerSec": 100}`,
+			updated: `{"maxReplicationLagMs": 5000}`,
+			want:    Limits{RecordsPerSec: 100, MaxReplicationLagMs: 5000},
+		},
+		{
+			name:    "invalid file",
+			file:    "throttle.yaml",
+			content: "recordsPerSec: [",
+			err:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			dir, err := ioutil.TempDir("", "throttle")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			file := filepath.Join(dir, tt.file)
+			if err := ioutil.WriteFile(file, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			th, err := New(tt.initial, file, nil)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// 修改控制檔後，下一個批次前重新讀取
+			if err := ioutil.WriteFile(file, []byte(tt.updated), 0644); err != nil {
+				t.Fatal(err)
+			}
+			mtime := time.Now().Add(time.Second)
+			if err := os.Chtimes(file, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			th.checkFile()
+
+			if got := th.Limits(); got != tt.want {
+				t.Errorf("Limits = %+v, want %+v", got, tt.want)
+			}
+
+			// 讀取失敗時維持原設定
+			if err := ioutil.WriteFile(file, []byte("{"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := th.reload(); err == nil {
+				t.Error("reload of an invalid file should fail")
+			}
+			if got := th.Limits(); got != tt.want {
+				t.Errorf("Limits after invalid reload = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
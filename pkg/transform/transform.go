@@ -0,0 +1,341 @@
+package transform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Spec 宣告式的轉換設定，每筆資料會依序套用所有符合條件的 rule，每個 rule 產生一筆 MigrationData
+type Spec struct {
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+type Rule struct {
+	Table      string      `json:"table" yaml:"table"`
+	Action     string      `json:"action" yaml:"action"`
+	ParentPath string      `json:"parentPath" yaml:"parentPath"`
+	When       []Condition `json:"when" yaml:"when"`
+	Ops        []Op        `json:"ops" yaml:"ops"`
+}
+
+// Condition 條件判斷，op 為 eq, ne, in, exists, missing
+type Condition struct {
+	Path  string      `json:"path" yaml:"path"`
+	Op    string      `json:"op" yaml:"op"`
+	Value interface{} `json:"value" yaml:"value"`
+}
+
+// Op 欄位操作，op 為 set, unset, rename, copy, default
+type Op struct {
+	Op    string      `json:"op" yaml:"op"`
+	Path  string      `json:"path" yaml:"path"`
+	From  string      `json:"from" yaml:"from"`
+	Value interface{} `json:"value" yaml:"value"`
+}
+
+// LoadSpec 讀取 YAML 或 JSON 格式的轉換設定檔
+func LoadSpec(path string) (*Spec, error) {
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Read transform spec error: %+v", err)
+		return nil, err
+	}
+
+	spec := &Spec{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, spec)
+	default:
+		err = json.Unmarshal(b, spec)
+	}
+	if err != nil {
+		log.Printf("Parse transform spec error: %+v", err)
+		return nil, err
+	}
+
+	for i, rule := range spec.Rules {
+		if rule.Table == "" {
+			return nil, fmt.Errorf("transform spec rule %d: table is required", i)
+		}
+		if rule.Action == "" {
+			spec.Rules[i].Action = "UPSERT"
+		}
+		for j, cond := range rule.When {
+			if err := cond.validate(); err != nil {
+				return nil, fmt.Errorf("transform spec rule %d condition %d: %v", i, j, err)
+			}
+			spec.Rules[i].When[j].Value = normalize(cond.Value)
+		}
+		for j, op := range rule.Ops {
+			if err := op.validate(); err != nil {
+				return nil, fmt.Errorf("transform spec rule %d op %d: %v", i, j, err)
+			}
+			spec.Rules[i].Ops[j].Value = normalize(op.Value)
+		}
+	}
+
+	return spec, nil
+}
+
+// Transform 實作 transformer.Transformer
+func (s *Spec) Transform(ctx context.Context, row dbMigration.Row) ([]dbMigration.MigrationData, error) {
+	return s.Apply(row)
+}
+
+// Apply 轉換一筆 query 撈出的資料
+func (s *Spec) Apply(row dbMigration.Row) ([]dbMigration.MigrationData, error) {
+
+	var origin map[string]interface{}
+	if err := json.Unmarshal([]byte(row.Data), &origin); err != nil {
+		return nil, err
+	}
+
+	mDatas := []dbMigration.MigrationData{}
+	for _, rule := range s.Rules {
+
+		if !rule.match(origin) {
+			continue
+		}
+
+		// 每個 rule 各自從原資料開始轉換
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(row.Data), &obj); err != nil {
+			return nil, err
+		}
+
+		for _, op := range rule.Ops {
+			if err := op.apply(obj); err != nil {
+				return nil, err
+			}
+		}
+
+		mData := dbMigration.MigrationData{
+			Table:  rule.Table,
+			Action: rule.Action,
+			Id:     row.Id,
+		}
+		if rule.Action != "DELETE" {
+			b, err := json.Marshal(obj)
+			if err != nil {
+				return nil, err
+			}
+			mData.Data = string(b)
+		}
+		if rule.ParentPath != "" {
+			if v, ok := getPath(obj, rule.ParentPath); ok {
+				mData.Parent = fmt.Sprint(v)
+			}
+		}
+
+		mDatas = append(mDatas, mData)
+	}
+
+	return mDatas, nil
+}
+
+func (r Rule) match(obj map[string]interface{}) bool {
+	return Match(r.When, obj)
+}
+
+// ParseConditions 解析 YAML 或 JSON 格式的條件清單，格式與 rule 的 when 相同
+func ParseConditions(s string) ([]Condition, error) {
+
+	conds := []Condition{}
+	if err := yaml.Unmarshal([]byte(s), &conds); err != nil {
+		return nil, err
+	}
+	for i, cond := range conds {
+		if err := cond.validate(); err != nil {
+			return nil, fmt.Errorf("condition %d: %v", i, err)
+		}
+		conds[i].Value = normalize(cond.Value)
+	}
+
+	return conds, nil
+}
+
+// Match 資料是否符合所有條件
+func Match(conds []Condition, obj map[string]interface{}) bool {
+
+	for _, cond := range conds {
+		v, ok := getPath(obj, cond.Path)
+
+		switch cond.Op {
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "missing":
+			if ok {
+				return false
+			}
+		case "ne":
+			if ok && equal(v, cond.Value) {
+				return false
+			}
+		case "in":
+			list, _ := cond.Value.([]interface{})
+			found := false
+			for _, item := range list {
+				if ok && equal(v, item) {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		case "eq", "":
+			if !ok || !equal(v, cond.Value) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// validate 未填 op 時視為 eq
+func (c Condition) validate() error {
+
+	switch c.Op {
+	case "eq", "", "ne", "in", "exists", "missing":
+	default:
+		return errors.New("unknown condition op: " + c.Op)
+	}
+	if c.Path == "" {
+		return errors.New("path is required")
+	}
+
+	return nil
+}
+
+func (op Op) validate() error {
+
+	switch op.Op {
+	case "set", "unset", "default":
+	case "rename", "copy":
+		if op.From == "" {
+			return errors.New(op.Op + " requires from")
+		}
+	default:
+		return errors.New("unknown transform op: " + op.Op)
+	}
+	if op.Path == "" {
+		return errors.New("path is required")
+	}
+
+	return nil
+}
+
+func (op Op) apply(obj map[string]interface{}) error {
+
+	switch op.Op {
+	case "set":
+		setPath(obj, op.Path, op.Value)
+	case "unset":
+		unsetPath(obj, op.Path)
+	case "default":
+		if v, ok := getPath(obj, op.Path); !ok || v == nil {
+			setPath(obj, op.Path, op.Value)
+		}
+	case "rename", "copy":
+		v, ok := getPath(obj, op.From)
+		if !ok {
+			return nil
+		}
+		setPath(obj, op.Path, v)
+		if op.Op == "rename" {
+			unsetPath(obj, op.From)
+		}
+	default:
+		return errors.New("unknown transform op: " + op.Op)
+	}
+
+	return nil
+}
+
+func getPath(obj map[string]interface{}, path string) (interface{}, bool) {
+
+	var v interface{} = obj
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+func setPath(obj map[string]interface{}, path string, value interface{}) {
+
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := obj[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			obj[key] = next
+		}
+		obj = next
+	}
+
+	obj[keys[len(keys)-1]] = value
+}
+
+func unsetPath(obj map[string]interface{}, path string) {
+
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := obj[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		obj = next
+	}
+
+	delete(obj, keys[len(keys)-1])
+}
+
+// equal 以 json 字串比對，避免 int 與 float64 型別不同
+func equal(a interface{}, b interface{}) bool {
+
+	ab, _ := json.Marshal(a)
+	bb, _ := json.Marshal(b)
+
+	return string(ab) == string(bb)
+}
+
+// normalize 將 yaml 解析出的 map[interface{}]interface{} 轉為 json 可用的型別
+func normalize(v interface{}) interface{} {
+
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, item := range val {
+			m[fmt.Sprint(k)] = normalize(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range val {
+			val[i] = normalize(item)
+		}
+		return val
+	default:
+		return v
+	}
+}
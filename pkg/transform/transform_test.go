@@ -0,0 +1,267 @@
+package transform
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+)
+
+func TestMatch(t *testing.T) {
+
+	obj := map[string]interface{}{
+		"status": float64(1),
+		"name":   "a",
+		"store":  map[string]interface{}{"id": "s1"},
+		"tmp":    nil,
+	}
+
+	tests := []struct {
+		name  string
+		conds []Condition
+		want  bool
+	}{
+		{"no conditions", nil, true},
+		{"eq", []Condition{{Path: "name", Op: "eq", Value: "a"}}, true},
+		{"empty op is eq", []Condition{{Path: "name", Value: "a"}}, true},
+		{"eq int and float", []Condition{{Path: "status", Op: "eq", Value: 1}}, true},
+		{"eq nested", []Condition{{Path: "store.id", Op: "eq", Value: "s1"}}, true},
+		{"eq mismatch", []Condition{{Path: "name", Op: "eq", Value: "b"}}, false},
+		{"eq missing", []Condition{{Path: "none", Op: "eq", Value: nil}}, false},
+		{"ne", []Condition{{Path: "name", Op: "ne", Value: "b"}}, true},
+		{"ne equal", []Condition{{Path: "name", Op: "ne", Value: "a"}}, false},
+		{"ne missing", []Condition{{Path: "none", Op: "ne", Value: "a"}}, true},
+		{"in", []Condition{{Path: "status", Op: "in", Value: []interface{}{2, 1}}}, true},
+		{"in mismatch", []Condition{{Path: "status", Op: "in", Value: []interface{}{2, 3}}}, false},
+		{"in missing", []Condition{{Path: "none", Op: "in", Value: []interface{}{nil}}}, false},
+		{"exists", []Condition{{Path: "tmp", Op: "exists"}}, true},
+		{"exists missing", []Condition{{Path: "none", Op: "exists"}}, false},
+		{"missing", []Condition{{Path: "none", Op: "missing"}}, true},
+		{"missing exists", []Condition{{Path: "name", Op: "missing"}}, false},
+		{"unknown op", []Condition{{Path: "name", Op: "like", Value: "a"}}, false},
+		{"all must match", []Condition{{Path: "name", Op: "eq", Value: "a"}, {Path: "status", Op: "eq", Value: 2}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Match(tt.conds, obj); got != tt.want {
+				t.Errorf("Match(%v) = %v, want %v", tt.conds, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+
+	row := dbMigration.Row{Id: "a", Data: `{"id": "a", "name": "n", "status": 1, "tmp": true, "store": {"id": "s1"}}`}
+
+	tests := []struct {
+		name  string
+		rules []Rule
+		want  []dbMigration.MigrationData
+		data  []map[string]interface{}
+		err   bool
+	}{
+		{
+			name:  "set and unset",
+			rules: []Rule{{Table: "t", Action: "UPSERT", Ops: []Op{{Op: "set", Path: "meta.v", Value: 2}, {Op: "unset", Path: "tmp"}}}},
+			want:  []dbMigration.MigrationData{{Table: "t", Action: "UPSERT", Id: "a"}},
+			data:  []map[string]interface{}{{"id": "a", "name": "n", "status": float64(1), "store": map[string]interface{}{"id": "s1"}, "meta": map[string]interface{}{"v": float64(2)}}},
+		},
+		{
+			name:  "rename copy default",
+			rules: []Rule{{Table: "t", Action: "UPSERT", Ops: []Op{{Op: "rename", From: "name", Path: "title"}, {Op: "copy", From: "title", Path: "meta.title"}, {Op: "default", Path: "status", Value: 9}, {Op: "default", Path: "kind", Value: "k"}}}},
+			want:  []dbMigration.MigrationData{{Table: "t", Action: "UPSERT", Id: "a"}},
+			data:  []map[string]interface{}{{"id": "a", "title": "n", "status": float64(1), "tmp": true, "store": map[string]interface{}{"id": "s1"}, "meta": map[string]interface{}{"title": "n"}, "kind": "k"}},
+		},
+		{
+			name: "rules start from the origin and skip unmatched",
+			rules: []Rule{
+				{Table: "t", Action: "UPSERT", Ops: []Op{{Op: "unset", Path: "tmp"}, {Op: "unset", Path: "store"}, {Op: "unset", Path: "name"}, {Op: "unset", Path: "status"}}},
+				{Table: "skipped", Action: "UPSERT", When: []Condition{{Path: "status", Op: "eq", Value: 2}}},
+				{Table: "d", Action: "DELETE", ParentPath: "store.id", When: []Condition{{Path: "tmp", Op: "exists"}}},
+			},
+			want: []dbMigration.MigrationData{{Table: "t", Action: "UPSERT", Id: "a"}, {Table: "d", Action: "DELETE", Id: "a", Parent: "s1"}},
+			data: []map[string]interface{}{{"id": "a"}, nil},
+		},
+		{
+			name:  "unknown op",
+			rules: []Rule{{Table: "t", Action: "UPSERT", Ops: []Op{{Op: "move", Path: "a"}}}},
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			mDatas, err := (&Spec{Rules: tt.rules}).Apply(row)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(mDatas) != len(tt.want) {
+				t.Fatalf("got %d records, want %d", len(mDatas), len(tt.want))
+			}
+
+			for i, mData := range mDatas {
+				var data map[string]interface{}
+				if mData.Data != "" {
+					if err := json.Unmarshal([]byte(mData.Data), &data); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if !reflect.DeepEqual(data, tt.data[i]) {
+					t.Errorf("record %d data = %v, want %v", i, data, tt.data[i])
+				}
+				mData.Data = ""
+				if !reflect.DeepEqual(mData, tt.want[i]) {
+					t.Errorf("record %d = %+v, want %+v", i, mData, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLoadSpec(t *testing.T) {
+
+	tests := []struct {
+		name string
+		file string
+		spec string
+		err  bool
+	}{
+		{
+			name: "yaml",
+			file: "spec.yaml",
+			spec: "rules:\n  - table: t\n    when:\n      - {path: status, op: in, value: [1, 2]}\n    ops:\n      - {op: set, path: a.b, value: {c: 1}}\n",
+		},
+		{
+			name: "json",
+			file: "spec.json",
+			spec: `{"rules": [{"table": "t", "action": "DELETE", "when": [{"path": "a"}]}]}`,
+		},
+		{
+			name: "missing table",
+			file: "spec.yaml",
+			spec: "rules:\n  - ops:\n      - {op: unset, path: a}\n",
+			err:  true,
+		},
+		{
+			name: "unknown condition op",
+			file: "spec.yaml",
+			spec: "rules:\n  - table: t\n    when:\n      - {path: a, op: gt, value: 1}\n",
+			err:  true,
+		},
+		{
+			name: "condition without path",
+			file: "spec.yaml",
+			spec: "rules:\n  - table: t\n    when:\n      - {op: exists}\n",
+			err:  true,
+		},
+		{
+			name: "unknown transform op",
+			file: "spec.yaml",
+			spec: "rules:\n  - table: t\n    ops:\n      - {op: move, path: a}\n",
+			err:  true,
+		},
+		{
+			name: "rename without from",
+			file: "spec.yaml",
+			spec: "rules:\n  - table: t\n    ops:\n      - {op: rename, path: a}\n",
+			err:  true,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "transform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			path := filepath.Join(dir, tt.file)
+			if err := ioutil.WriteFile(path, []byte(tt.spec), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			spec, err := LoadSpec(path)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spec.Rules[0].Action == "" {
+				t.Error("action should default to UPSERT")
+			}
+			// yaml 的物件需轉為 json 可用的型別
+			for _, op := range spec.Rules[0].Ops {
+				if _, err := json.Marshal(op.Value); err != nil {
+					t.Errorf("op value is not json: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConditions(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		s     string
+		conds []Condition
+		err   bool
+	}{
+		{
+			name:  "yaml",
+			s:     "[{path: status, op: in, value: [1, 2]}, {path: a.b, op: exists}]",
+			conds: []Condition{{Path: "status", Op: "in", Value: []interface{}{1, 2}}, {Path: "a.b", Op: "exists"}},
+		},
+		{
+			name:  "json",
+			s:     `[{"path": "storeId", "op": "eq", "value": {"id": "s1"}}]`,
+			conds: []Condition{{Path: "storeId", Op: "eq", Value: map[string]interface{}{"id": "s1"}}},
+		},
+		{
+			name:  "empty op",
+			s:     "[{path: storeId, value: s1}]",
+			conds: []Condition{{Path: "storeId", Value: "s1"}},
+		},
+		{name: "missing path", s: "[{op: exists}]", err: true},
+		{name: "unknown op", s: "[{path: a, op: gt, value: 1}]", err: true},
+		{name: "not a list", s: "{path: a}", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			conds, err := ParseConditions(tt.s)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("ParseConditions(%s) expected error", tt.s)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(conds, tt.conds) {
+				t.Errorf("ParseConditions(%s) = %#v, want %#v", tt.s, conds, tt.conds)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package transformer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+)
+
+// Transformer 編譯進執行檔的 migration，將 query 撈出的一筆資料轉為要寫入的資料
+type Transformer interface {
+	Transform(ctx context.Context, row dbMigration.Row) ([]dbMigration.MigrationData, error)
+}
+
+// Func 讓一般 function 可作為 Transformer 使用
+type Func func(ctx context.Context, row dbMigration.Row) ([]dbMigration.MigrationData, error)
+
+func (f Func) Transform(ctx context.Context, row dbMigration.Row) ([]dbMigration.MigrationData, error) {
+	return f(ctx, row)
+}
+
+var (
+	mu           sync.RWMutex
+	transformers = map[string]Transformer{}
+)
+
+// Register 註冊 Transformer，通常在 migration package 的 init 呼叫，名稱重複時 panic
+func Register(name string, t Transformer) {
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if t == nil {
+		panic("transformer: Register transformer is nil")
+	}
+	if _, dup := transformers[name]; dup {
+		panic("transformer: Register called twice for transformer " + name)
+	}
+	transformers[name] = t
+}
+
+// Get 依名稱取得已註冊的 Transformer
+func Get(name string) (Transformer, error) {
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	t, ok := transformers[name]
+	if !ok {
+		return nil, fmt.Errorf("transformer: unknown transformer %q (registered: %v)", name, names())
+	}
+
+	return t, nil
+}
+
+// Names 已註冊的 Transformer 名稱
+func Names() []string {
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return names()
+}
+
+func names() []string {
+
+	list := []string{}
+	for name := range transformers {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+
+	return list
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// JsonPathValue 依照以 . 分隔的路徑取出 json 內的值，數字為 json.Number
+func JsonPathValue(data string, path string) (interface{}, bool) {
+
+	v, err := DecodeJson(data)
+	if err != nil {
+		return nil, false
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+// JsonPathString 依照以 . 分隔的路徑取出 json 內的值，找不到時回傳空字串
+func JsonPathString(data string, path string) string {
+
+	v, _ := JsonPathValue(data, path)
+
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(val)
+		return string(b)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// MergeJson 將 patch 合併進 origin，物件會遞迴合併，其他型別直接覆蓋，與ES partial update 相同
+func MergeJson(origin string, patch string) (string, error) {
+
+	o, err := DecodeJson(origin)
+	if err != nil {
+		return "", err
+	}
+	p, err := DecodeJson(patch)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(mergeValue(o, p))
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func mergeValue(origin interface{}, patch interface{}) interface{} {
+
+	oObj, ok := origin.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	pObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	for key, v := range pObj {
+		oObj[key] = mergeValue(oObj[key], v)
+	}
+
+	return oObj
+}
+
+// DecodeJson 解析 json，數字保留為 json.Number，避免超過 2^53 的整數失去精度
+func DecodeJson(s string) (interface{}, error) {
+
+	var v interface{}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after json")
+	}
+
+	return v, nil
+}
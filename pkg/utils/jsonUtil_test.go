@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJsonPathValue(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		data  string
+		path  string
+		value interface{}
+		ok    bool
+	}{
+		{"top level", `{"a": "x"}`, "a", "x", true},
+		{"nested", `{"a": {"b": {"c": 1}}}`, "a.b.c", json.Number("1"), true},
+		{"bigint", `{"a": 9007199254740993}`, "a", json.Number("9007199254740993"), true},
+		{"null value", `{"a": null}`, "a", nil, true},
+		{"object value", `{"a": {"b": 1}}`, "a", map[string]interface{}{"b": json.Number("1")}, true},
+		{"missing key", `{"a": {"b": 1}}`, "a.c", nil, false},
+		{"through non object", `{"a": [1, 2]}`, "a.b", nil, false},
+		{"invalid json", `{"a"`, "a", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, ok := JsonPathValue(tt.data, tt.path)
+			if ok != tt.ok || !reflect.DeepEqual(v, tt.value) {
+				t.Errorf("JsonPathValue(%s, %s) = %v, %v, want %v, %v", tt.data, tt.path, v, ok, tt.value, tt.ok)
+			}
+		})
+	}
+}
+
+func TestJsonPathString(t *testing.T) {
+
+	tests := []struct {
+		name string
+		data string
+		path string
+		want string
+	}{
+		{"string", `{"storeId": "abc"}`, "storeId", "abc"},
+		{"number", `{"a": {"n": 12}}`, "a.n", "12"},
+		{"bigint", `{"a": 9007199254740993}`, "a", "9007199254740993"},
+		{"number literal", `{"a": 1.50}`, "a", "1.50"},
+		{"bool", `{"a": true}`, "a", "true"},
+		{"object", `{"a": {"b": 1}}`, "a", `{"b":1}`},
+		{"array", `{"a": [1, "x"]}`, "a", `[1,"x"]`},
+		{"null", `{"a": null}`, "a", ""},
+		{"missing", `{}`, "a", ""},
+		{"through non object", `{"a": [1]}`, "a.b", ""},
+		{"invalid json", `{"a"`, "a", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := JsonPathString(tt.data, tt.path); got != tt.want {
+				t.Errorf("JsonPathString(%s, %s) = %q, want %q", tt.data, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeJson(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		origin string
+		patch  string
+		want   string
+		err    bool
+	}{
+		{"add key", `{"a": 1}`, `{"b": 2}`, `{"a": 1, "b": 2}`, false},
+		{"overwrite value", `{"a": 1}`, `{"a": "x"}`, `{"a": "x"}`, false},
+		{"merge nested objects", `{"a": {"b": 1, "c": 2}}`, `{"a": {"c": 3}}`, `{"a": {"b": 1, "c": 3}}`, false},
+		{"replace array", `{"a": [1, 2]}`, `{"a": [3]}`, `{"a": [3]}`, false},
+		{"object replaces scalar", `{"a": 1}`, `{"a": {"b": 2}}`, `{"a": {"b": 2}}`, false},
+		{"null is kept", `{"a": 1}`, `{"a": null}`, `{"a": null}`, false},
+		{"large integers", `{"a": 9007199254740993}`, `{"b": 9007199254740995}`, `{"a": 9007199254740993, "b": 9007199254740995}`, false},
+		{"number literal", `{"a": 1.50}`, `{"b": 1e2}`, `{"a": 1.50, "b": 1e2}`, false},
+		{"invalid origin", `{`, `{}`, "", true},
+		{"invalid patch", `{}`, `{`, "", true},
+		{"trailing data", `{}`, `{} {}`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MergeJson(tt.origin, tt.patch)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("MergeJson(%s, %s) expected error", tt.origin, tt.patch)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gv, _ := DecodeJson(got)
+			wv, _ := DecodeJson(tt.want)
+			if !reflect.DeepEqual(gv, wv) {
+				t.Errorf("MergeJson(%s, %s) = %s, want %s", tt.origin, tt.patch, got, tt.want)
+			}
+		})
+	}
+}
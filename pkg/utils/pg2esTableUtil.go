@@ -1,6 +1,7 @@
 package utils
 
-var PgEsTableMapping = map[string]string{
+// 未設定 TABLE_CONFIG 時使用的預設 PG table 對應 ES type
+var defaultEsTypes = map[string]string{
 	"orderregular":  "orderRegular",
 	"fbstore":       "fbStore",
 	"storeapp":      "storeApp",
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// Crockford base32，與 ULID 相同，字典序即時間順序
+const runIdAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// legacyRunIdLayout 舊版以執行時間（秒）作為備份名稱
+const legacyRunIdLayout = "20060102150405"
+
+// NewRunId 產生 ULID 格式的 run ID：前 48 bits 為毫秒時間，後 80 bits 為亂數，共 26 字元
+func NewRunId(t time.Time) string {
+
+	var b [16]byte
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint16(b[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(b[2:6], uint32(ms))
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic(err)
+	}
+
+	// 128 bits 前補 2 個 0 bit，每 5 bits 一個字元
+	hi := binary.BigEndian.Uint64(b[0:8])
+	lo := binary.BigEndian.Uint64(b[8:16])
+	id := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		id[i] = runIdAlphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+
+	return string(id)
+}
+
+// IsRunId 是否為 ULID 格式的 run ID 或舊版的時間字串
+func IsRunId(id string) bool {
+
+	if len(id) == len(legacyRunIdLayout) {
+		_, err := time.Parse(legacyRunIdLayout, id)
+		return err == nil
+	}
+
+	if len(id) != 26 || id[0] > '7' {
+		return false
+	}
+	for _, c := range id {
+		if !strings.ContainsRune(runIdAlphabet, c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RunIdTime run ID 的產生時間
+func RunIdTime(id string) time.Time {
+
+	if len(id) == len(legacyRunIdLayout) {
+		t, _ := time.Parse(legacyRunIdLayout, id)
+		return t
+	}
+
+	ms := decodeRunId(id[:10])
+
+	return time.Unix(0, int64(ms)*int64(time.Millisecond)).UTC()
+}
+
+// RunIdVersion 寫入ES的 external version：毫秒時間換算為奈秒，再以亂數部分區分同一毫秒的執行，
+// 與舊版以奈秒時間為 version 的資料可直接比較
+func RunIdVersion(id string) int64 {
+
+	if len(id) == len(legacyRunIdLayout) {
+		return RunIdTime(id).UnixNano()
+	}
+
+	return RunIdTime(id).UnixNano() + int64(decodeRunId(id[22:])%uint64(time.Millisecond))
+}
+
+func decodeRunId(s string) uint64 {
+
+	var n uint64
+	for _, c := range s {
+		n = n<<5 | uint64(strings.IndexRune(runIdAlphabet, c))
+	}
+
+	return n
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewRunId(t *testing.T) {
+
+	tests := []struct {
+		name string
+		time time.Time
+	}{
+		{"now", time.Now()},
+		{"epoch", time.Unix(0, 0)},
+		{"millisecond", time.Date(2018, 3, 21, 9, 30, 0, 123456789, time.UTC)},
+		{"other zone", time.Date(2018, 3, 21, 17, 30, 0, 0, time.FixedZone("CST", 8*3600))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			id := NewRunId(tt.time)
+			if !IsRunId(id) {
+				t.Fatalf("IsRunId(%s) = false", id)
+			}
+
+			want := tt.time.Truncate(time.Millisecond)
+			if got := RunIdTime(id); !got.Equal(want) {
+				t.Errorf("RunIdTime(%s) = %v, want %v", id, got, want)
+			}
+
+			// 同一毫秒以亂數部分區分，不會超過下一毫秒
+			version := RunIdVersion(id)
+			if version < want.UnixNano() || version >= want.Add(time.Millisecond).UnixNano() {
+				t.Errorf("RunIdVersion(%s) = %d, want within the millisecond %d", id, version, want.UnixNano())
+			}
+		})
+	}
+}
+
+func TestRunIdOrder(t *testing.T) {
+
+	t1 := time.Date(2018, 3, 21, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		a    time.Time
+		b    time.Time
+	}{
+		{"millisecond", t1, t1.Add(time.Millisecond)},
+		{"year", t1, t1.AddDate(1, 0, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := NewRunId(tt.a), NewRunId(tt.b)
+			if a >= b {
+				t.Errorf("%s should sort before %s", a, b)
+			}
+			if RunIdVersion(a) >= RunIdVersion(b) {
+				t.Errorf("version of %s should be lower than %s", a, b)
+			}
+		})
+	}
+}
+
+func TestIsRunId(t *testing.T) {
+
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"01JAB3QK2H7M4X9R8T6V5W2Y1Z", true},
+		{"7ZZZZZZZZZZZZZZZZZZZZZZZZZ", true},
+		{"20180321093000", true},
+		{"01jab3qk2h7m4x9r8t6v5w2y1z", false},
+		{"81JAB3QK2H7M4X9R8T6V5W2Y1Z", false},
+		{"01JAB3QK2H7M4X9R8T6V5W2Y1I", false},
+		{"01JAB3QK2H7M4X9R8T6V5W2Y1", false},
+		{"20181321093000", false},
+		{"2018032109300a", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if got := IsRunId(tt.id); got != tt.want {
+				t.Errorf("IsRunId(%q) = %v, want %v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLegacyRunId(t *testing.T) {
+
+	tests := []struct {
+		id   string
+		want time.Time
+	}{
+		{"20180321093000", time.Date(2018, 3, 21, 9, 30, 0, 0, time.UTC)},
+		{"20171231235959", time.Date(2017, 12, 31, 23, 59, 59, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if got := RunIdTime(tt.id); !got.Equal(tt.want) {
+				t.Errorf("RunIdTime(%s) = %v, want %v", tt.id, got, tt.want)
+			}
+			if got := RunIdVersion(tt.id); got != tt.want.UnixNano() {
+				t.Errorf("RunIdVersion(%s) = %d, want %d", tt.id, got, tt.want.UnixNano())
+			}
+		})
+	}
+}
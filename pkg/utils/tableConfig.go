@@ -0,0 +1,323 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	elastic "gopkg.in/olivere/elastic.v5"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// TableConfig PG table 與 ES 的對應設定，未設定的欄位會在 GetTableConfig 補上預設值
+type TableConfig struct {
+	Table        string `json:"-" yaml:"-"`
+	EsIndex      string `json:"esIndex" yaml:"esIndex"`
+	EsType       string `json:"esType" yaml:"esType"`
+	ParentPath   string `json:"parentPath" yaml:"parentPath"`
+	RoutingField string `json:"routingField" yaml:"routingField"`
+	EsSync       *bool  `json:"esSync" yaml:"esSync"`
+	IdColumn     string `json:"idColumn" yaml:"idColumn"`
+	DataColumn   string `json:"dataColumn" yaml:"dataColumn"`
+
+	// Columns 額外的 PG 欄位，key 為欄位名稱，value 為 plugin 未提供時由 data 取值的路徑
+	Columns map[string]string `json:"columns" yaml:"columns"`
+
+	// Schema data 需符合的 JSON Schema 檔案，可不填
+	Schema string `json:"schema" yaml:"schema"`
+}
+
+type tableConfigFile struct {
+	Tables map[string]TableConfig `json:"tables" yaml:"tables"`
+}
+
+var tableConfigs = map[string]TableConfig{}
+
+// LoadTableConfig 讀取 YAML 或 JSON 格式的 table 設定檔，path 為空時使用預設對應
+func LoadTableConfig(path string) error {
+
+	if path == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Read table config error: %+v", err)
+		return err
+	}
+
+	cf := tableConfigFile{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &cf)
+	default:
+		err = json.Unmarshal(b, &cf)
+	}
+	if err != nil {
+		log.Printf("Parse table config error: %+v", err)
+		return err
+	}
+
+	tableConfigs = map[string]TableConfig{}
+	for table, c := range cf.Tables {
+		c.Table = table
+		tableConfigs[table] = c
+	}
+
+	return nil
+}
+
+// IsConfigured table 是否在設定檔內，設定檔內的 table 已於啟動時檢查過
+func IsConfigured(table string) bool {
+	_, ok := tableConfigs[table]
+	return ok
+}
+
+// GetTableConfig 取得 table 設定，未設定的 table 沿用預設對應
+func GetTableConfig(table string) TableConfig {
+
+	c := tableConfigs[table]
+	c.Table = table
+
+	if c.EsIndex == "" {
+		c.EsIndex = os.Getenv("ELASTIC_DB")
+	}
+	if c.EsType == "" {
+		c.EsType = defaultEsTypes[table]
+	}
+	if c.EsType == "" {
+		c.EsType = table
+	}
+	if c.ParentPath == "" {
+		c.ParentPath = "__parent"
+	}
+	if c.IdColumn == "" {
+		c.IdColumn = "id"
+	}
+	if c.DataColumn == "" {
+		c.DataColumn = "data"
+	}
+
+	return c
+}
+
+// Synced 是否需同步至 ES
+func (c TableConfig) Synced() bool {
+	return c.EsSync == nil || *c.EsSync
+}
+
+// IdIdent SQL 內使用的 id 欄位名稱
+func (c TableConfig) IdIdent() string {
+	return pq.QuoteIdentifier(c.IdColumn)
+}
+
+// DataIdent SQL 內使用的 data 欄位名稱
+func (c TableConfig) DataIdent() string {
+	return pq.QuoteIdentifier(c.DataColumn)
+}
+
+// ParentExpr 由 data 欄位取出 parent 的 SQL 語法
+func (c TableConfig) ParentExpr() string {
+	return fmt.Sprintf("COALESCE(%s #>> '{%s}', '')", c.DataIdent(), strings.Replace(c.ParentPath, ".", ",", -1))
+}
+
+// Parent 由 data json 取出 parent
+func (c TableConfig) Parent(data string) string {
+	return JsonPathString(data, c.ParentPath)
+}
+
+// Routing 由 data json 取出 ES routing，未設定 routingField 時回傳空字串
+func (c TableConfig) Routing(data string) string {
+
+	if c.RoutingField == "" {
+		return ""
+	}
+
+	return JsonPathString(data, c.RoutingField)
+}
+
+// ColumnNames 依名稱排序的額外欄位
+func (c TableConfig) ColumnNames() []string {
+
+	names := []string{}
+	for name := range c.Columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// InsertColumns INSERT 時的欄位列表
+func (c TableConfig) InsertColumns() string {
+
+	columns := []string{c.IdIdent(), c.DataIdent()}
+	for _, name := range c.ColumnNames() {
+		columns = append(columns, pq.QuoteIdentifier(name))
+	}
+
+	return strings.Join(columns, ", ")
+}
+
+// ColumnsExpr 將額外欄位組成 json 字串的 SQL 語法，供備份使用
+func (c TableConfig) ColumnsExpr() string {
+
+	if len(c.Columns) == 0 {
+		return "'{}'"
+	}
+
+	pairs := []string{}
+	for _, name := range c.ColumnNames() {
+		pairs = append(pairs, fmt.Sprintf("'%s', %s", strings.Replace(name, "'", "''", -1), pq.QuoteIdentifier(name)))
+	}
+
+	return fmt.Sprintf("json_build_object(%s)::text", strings.Join(pairs, ", "))
+}
+
+// InsertValues 組出 INSERT 一筆資料的 VALUES，
+// 額外欄位優先使用 columns，未提供時由 data 依設定路徑取值，皆無則使用 DEFAULT
+func (c TableConfig) InsertValues(id string, data string, columns map[string]interface{}) string {
+
+	values := []string{SqlLiteral(id), SqlLiteral(data)}
+	for _, name := range c.ColumnNames() {
+		v, ok := columns[name]
+		if !ok && c.Columns[name] != "" {
+			v, ok = JsonPathValue(data, c.Columns[name])
+		}
+
+		if ok {
+			values = append(values, SqlLiteral(v))
+		} else {
+			values = append(values, "DEFAULT")
+		}
+	}
+
+	return "(" + strings.Join(values, ", ") + ")"
+}
+
+// UpdateSets 組出 UPDATE 時額外欄位的 SET，優先使用 columns，
+// 未提供時由 data 依設定路徑重新取值，取不到則使用 DEFAULT；data 為空時只包含 columns
+func (c TableConfig) UpdateSets(data string, columns map[string]interface{}) []string {
+
+	sets := []string{}
+	for _, name := range c.ColumnNames() {
+		v, ok := columns[name]
+		if !ok {
+			if c.Columns[name] == "" || data == "" {
+				continue
+			}
+			if v, ok = JsonPathValue(data, c.Columns[name]); !ok {
+				sets = append(sets, fmt.Sprintf("%s = DEFAULT", pq.QuoteIdentifier(name)))
+				continue
+			}
+		}
+		sets = append(sets, fmt.Sprintf("%s = %s", pq.QuoteIdentifier(name), SqlLiteral(v)))
+	}
+
+	return sets
+}
+
+// Derived 是否有未由 columns 提供、需由 data 取值的額外欄位
+func (c TableConfig) Derived(columns map[string]interface{}) bool {
+
+	for name, path := range c.Columns {
+		if _, ok := columns[name]; !ok && path != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SqlLiteral 將值轉為 SQL 字串常數，交由 PG 依欄位型別轉換，json.Number 保留原本的寫法
+func SqlLiteral(v interface{}) string {
+
+	var s string
+	switch val := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		s = val
+	case json.Number:
+		s = val.String()
+	default:
+		b, _ := json.Marshal(val)
+		s = string(b)
+	}
+
+	// escape '
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// ValidateTableConfig 確認設定檔內的 table 存在於 PG，且 ES mapping 已建立
+func ValidateTableConfig(db *sql.DB, es *elastic.Client) error {
+
+	ctx := context.Background()
+
+	for table := range tableConfigs {
+
+		c := GetTableConfig(table)
+
+		rows, err := db.Query("SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1", table)
+		if err != nil {
+			log.Printf("PG catalog error: %+v", err)
+			return err
+		}
+
+		columns := map[string]bool{}
+		for rows.Next() {
+			var column string
+			if err := rows.Scan(&column); err != nil {
+				rows.Close()
+				log.Printf("PG catalog scan error: %+v", err)
+				return err
+			}
+			columns[column] = true
+		}
+		rows.Close()
+
+		if len(columns) == 0 {
+			log.Printf("Table config error: table %s not found in postgres\n", table)
+			return errors.New("table config error")
+		}
+		for _, column := range append([]string{c.IdColumn, c.DataColumn}, c.ColumnNames()...) {
+			if !columns[column] {
+				log.Printf("Table config error: column %s not found in table %s\n", column, table)
+				return errors.New("table config error")
+			}
+		}
+
+		if !c.Synced() {
+			continue
+		}
+
+		mappings, err := es.GetMapping().Index(c.EsIndex).Type(c.EsType).Do(ctx)
+		if err != nil {
+			log.Printf("Table config error: ES mapping %s/%s: %+v", c.EsIndex, c.EsType, err)
+			return err
+		}
+
+		found := false
+		for _, index := range mappings {
+			idx, _ := index.(map[string]interface{})
+			if m, ok := idx["mappings"].(map[string]interface{}); ok && m[c.EsType] != nil {
+				found = true
+			}
+		}
+		if !found {
+			log.Printf("Table config error: ES mapping %s/%s not found\n", c.EsIndex, c.EsType)
+			return errors.New("table config error")
+		}
+	}
+
+	return nil
+}
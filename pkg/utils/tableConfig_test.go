@@ -0,0 +1,307 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadTableConfig(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		file   string
+		config string
+		want   TableConfig
+		err    bool
+	}{
+		{
+			name:   "yaml",
+			file:   "tables.yaml",
+			config: "tables:\n  orders:\n    esIndex: shop\n    esType: order\n    parentPath: store.id\n    esSync: false\n",
+			want:   TableConfig{Table: "orders", EsIndex: "shop", EsType: "order", ParentPath: "store.id", IdColumn: "id", DataColumn: "data"},
+		},
+		{
+			name:   "json",
+			file:   "tables.json",
+			config: `{"tables": {"orders": {"routingField": "storeId", "idColumn": "uid", "dataColumn": "doc", "columns": {"storeId": "store.id"}}}}`,
+			want:   TableConfig{Table: "orders", EsIndex: "default", EsType: "order", ParentPath: "__parent", RoutingField: "storeId", IdColumn: "uid", DataColumn: "doc", Columns: map[string]string{"storeId": "store.id"}},
+		},
+		{
+			name:   "invalid yaml",
+			file:   "tables.yml",
+			config: "tables: [",
+			err:    true,
+		},
+		{
+			name:   "invalid json",
+			file:   "tables.json",
+			config: "{",
+			err:    true,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "utils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { tableConfigs = map[string]TableConfig{} }()
+	t.Setenv("ELASTIC_DB", "default")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			path := filepath.Join(dir, tt.file)
+			if err := ioutil.WriteFile(path, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := LoadTableConfig(path)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := GetTableConfig("orders")
+			synced := c.Synced()
+			c.EsSync = nil
+			if !reflect.DeepEqual(c, tt.want) {
+				t.Errorf("GetTableConfig = %+v, want %+v", c, tt.want)
+			}
+			if synced != (tt.name != "yaml") {
+				t.Errorf("Synced() = %v", synced)
+			}
+		})
+	}
+
+	if err := LoadTableConfig(filepath.Join(dir, "none.yaml")); err == nil {
+		t.Error("missing config file should fail")
+	}
+}
+
+func TestGetTableConfigDefaults(t *testing.T) {
+
+	t.Setenv("ELASTIC_DB", "meepshop")
+	tableConfigs = map[string]TableConfig{}
+
+	tests := []struct {
+		table  string
+		esType string
+	}{
+		{"orders", "order"},
+		{"orderproduct", "orderProduct"},
+		{"product", "product"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.table, func(t *testing.T) {
+			c := GetTableConfig(tt.table)
+			want := TableConfig{Table: tt.table, EsIndex: "meepshop", EsType: tt.esType, ParentPath: "__parent", IdColumn: "id", DataColumn: "data"}
+			if !reflect.DeepEqual(c, want) {
+				t.Errorf("GetTableConfig(%s) = %+v, want %+v", tt.table, c, want)
+			}
+			if !c.Synced() {
+				t.Errorf("%s should be synced by default", tt.table)
+			}
+		})
+	}
+}
+
+func TestParentAndRouting(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		c       TableConfig
+		data    string
+		parent  string
+		routing string
+		expr    string
+	}{
+		{
+			name:   "default parent path",
+			c:      TableConfig{ParentPath: "__parent", DataColumn: "data"},
+			data:   `{"__parent": "p1", "storeId": "s1"}`,
+			parent: "p1",
+			expr:   `COALESCE("data" #>> '{__parent}', '')`,
+		},
+		{
+			name:    "nested parent and routing",
+			c:       TableConfig{ParentPath: "store.id", RoutingField: "storeId", DataColumn: "doc"},
+			data:    `{"store": {"id": "s1"}, "storeId": "r1"}`,
+			parent:  "s1",
+			routing: "r1",
+			expr:    `COALESCE("doc" #>> '{store,id}', '')`,
+		},
+		{
+			name:   "quoted data column",
+			c:      TableConfig{ParentPath: "__parent", DataColumn: "Doc Data"},
+			data:   `{"__parent": "p1"}`,
+			parent: "p1",
+			expr:   `COALESCE("Doc Data" #>> '{__parent}', '')`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.Parent(tt.data); got != tt.parent {
+				t.Errorf("Parent = %q, want %q", got, tt.parent)
+			}
+			if got := tt.c.Routing(tt.data); got != tt.routing {
+				t.Errorf("Routing = %q, want %q", got, tt.routing)
+			}
+			if got := tt.c.ParentExpr(); got != tt.expr {
+				t.Errorf("ParentExpr = %s, want %s", got, tt.expr)
+			}
+		})
+	}
+}
+
+var columnsConfig = TableConfig{
+	Table:      "orders",
+	IdColumn:   "id",
+	DataColumn: "data",
+	Columns:    map[string]string{"storeId": "store.id", "status": "status", "note": ""},
+}
+
+func TestInsertColumns(t *testing.T) {
+
+	tests := []struct {
+		name string
+		c    TableConfig
+		want string
+	}{
+		{"columns", columnsConfig, `"id", "data", "note", "status", "storeId"`},
+		{"custom id and data", TableConfig{IdColumn: "Uid", DataColumn: "doc data"}, `"Uid", "doc data"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.InsertColumns(); got != tt.want {
+				t.Errorf("InsertColumns = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInsertValues(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		data    string
+		columns map[string]interface{}
+		want    string
+	}{
+		{
+			name: "from data",
+			data: `{"store": {"id": "s1"}, "status": 2}`,
+			want: `('o1', '{"store": {"id": "s1"}, "status": 2}', DEFAULT, '2', 's1')`,
+		},
+		{
+			name:    "columns first",
+			data:    `{"store": {"id": "s1"}, "status": 2}`,
+			columns: map[string]interface{}{"storeId": "s2", "note": "it's"},
+			want:    `('o1', '{"store": {"id": "s1"}, "status": 2}', 'it''s', '2', 's2')`,
+		},
+		{
+			name: "bigint from data",
+			data: `{"store": {"id": 9007199254740993}, "status": 2}`,
+			want: `('o1', '{"store": {"id": 9007199254740993}, "status": 2}', DEFAULT, '2', '9007199254740993')`,
+		},
+		{
+			name:    "null column",
+			data:    `{}`,
+			columns: map[string]interface{}{"status": nil},
+			want:    `('o1', '{}', DEFAULT, NULL, DEFAULT)`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := columnsConfig.InsertValues("o1", tt.data, tt.columns); got != tt.want {
+				t.Errorf("InsertValues = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateSets(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		data    string
+		columns map[string]interface{}
+		want    []string
+		derived bool
+	}{
+		{
+			name:    "recomputed from data",
+			data:    `{"store": {"id": "s1"}, "status": 2}`,
+			want:    []string{`"status" = '2'`, `"storeId" = 's1'`},
+			derived: true,
+		},
+		{
+			name:    "missing path uses default",
+			data:    `{"status": 2}`,
+			want:    []string{`"status" = '2'`, `"storeId" = DEFAULT`},
+			derived: true,
+		},
+		{
+			name:    "columns only without data",
+			columns: map[string]interface{}{"note": "x"},
+			want:    []string{`"note" = 'x'`},
+			derived: true,
+		},
+		{
+			name:    "all columns provided",
+			data:    `{"store": {"id": "s1"}, "status": 2}`,
+			columns: map[string]interface{}{"storeId": "s2", "status": 3},
+			want:    []string{`"status" = '3'`, `"storeId" = 's2'`},
+			derived: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := columnsConfig.UpdateSets(tt.data, tt.columns); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("UpdateSets = %v, want %v", got, tt.want)
+			}
+			if got := columnsConfig.Derived(tt.columns); got != tt.derived {
+				t.Errorf("Derived = %v, want %v", got, tt.derived)
+			}
+		})
+	}
+}
+
+func TestSqlLiteral(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"nil", nil, "NULL"},
+		{"string", "a'b", "'a''b'"},
+		{"number", 1.5, "'1.5'"},
+		{"json number", json.Number("9007199254740993"), "'9007199254740993'"},
+		{"json number literal", json.Number("1.50"), "'1.50'"},
+		{"bool", true, "'true'"},
+		{"object", map[string]interface{}{"k": "it's"}, `'{"k":"it''s"}'`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SqlLiteral(tt.value); got != tt.want {
+				t.Errorf("SqlLiteral(%v) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package wasmPlugin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Plugin 於沙箱內執行 WASM plugin，guest 需 export：
+//
+//	memory
+//	alloc(size i32) i32                  配置 size bytes 供 host 寫入輸入資料
+//	migration(ptr i32, len i32) i64      傳入 json 資料，回傳 (ptr << 32 | len) 指向輸出
+//	dealloc(ptr i32, len i32)            可不提供，host 讀完資料後釋放
+//
+// 輸出與 plugin 寫到 stdout 的格式相同，或以 {"error": "..."} 回報錯誤．
+// guest 只有 WASI 的時間及亂數可用，沒有檔案系統及網路．
+type Plugin struct {
+	path     string
+	timeout  time.Duration
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	pool     chan api.Module
+}
+
+type result struct {
+	Error string
+}
+
+// Load 編譯 WASM plugin 並建立 size 個 instance 供多個 goroutine 共用，
+// memoryMB 為每個 instance 的記憶體上限，timeout 為每次呼叫的 CPU 時間上限，0 為不限制
+func Load(path string, size int, memoryMB int, timeout time.Duration) (*Plugin, error) {
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Read wasm plugin error: %+v", err)
+		return nil, err
+	}
+
+	ctx := context.Background()
+
+	// 每頁 64KiB
+	config := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if memoryMB > 0 {
+		config = config.WithMemoryLimitPages(uint32(memoryMB * 16))
+	}
+	r := wazero.NewRuntimeWithConfig(ctx, config)
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+
+	// AssemblyScript 需要的 abort
+	_, err = r.NewHostModuleBuilder("env").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, msg, file, line, col uint32) {
+			panic(fmt.Sprintf("wasm plugin abort at %d:%d", line, col))
+		}).
+		Export("abort").
+		Instantiate(ctx)
+	if err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+
+	compiled, err := r.CompileModule(ctx, b)
+	if err != nil {
+		r.Close(ctx)
+		log.Printf("Compile wasm plugin error: %+v", err)
+		return nil, err
+	}
+
+	if size < 1 {
+		size = 1
+	}
+
+	p := &Plugin{path: path, timeout: timeout, runtime: r, compiled: compiled, pool: make(chan api.Module, size)}
+	for i := 0; i < size; i++ {
+		mod, err := p.instantiate(ctx)
+		if err != nil {
+			p.Close()
+			log.Printf("Init wasm plugin error: %+v", err)
+			return nil, err
+		}
+		p.pool <- mod
+	}
+
+	return p, nil
+}
+
+func (p *Plugin) instantiate(ctx context.Context) (api.Module, error) {
+
+	// 僅呼叫 reactor 的 _initialize，command 的 _start 執行完會結束 module
+	config := wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize").
+		WithStderr(os.Stderr).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithRandSource(rand.Reader)
+
+	mod, err := p.runtime.InstantiateModule(ctx, p.compiled, config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{"alloc", "migration"} {
+		if mod.ExportedFunction(name) == nil {
+			mod.Close(ctx)
+			return nil, errors.New("wasm plugin does not export " + name)
+		}
+	}
+
+	return mod, nil
+}
+
+// Transform 實作 transformer.Transformer，可同時由多個 goroutine 呼叫
+func (p *Plugin) Transform(ctx context.Context, row dbMigration.Row) ([]dbMigration.MigrationData, error) {
+
+	var mod api.Module
+	select {
+	case mod = <-p.pool:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// 先前重建失敗的位置放的是 nil，使用時再建立
+	if mod == nil {
+		newMod, initErr := p.instantiate(context.Background())
+		if initErr != nil {
+			p.pool <- nil
+			log.Printf("Reinit wasm plugin error: %+v", initErr)
+			return nil, initErr
+		}
+		mod = newMod
+	}
+
+	callCtx := ctx
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	out, err := p.call(callCtx, mod, []byte(row.Data))
+
+	// 逾時或發生錯誤時 instance 可能已關閉或狀態不明，換一個新的；
+	// 重建失敗時放回 nil 保留位置，避免 pool 越來越少
+	if err != nil {
+		mod.Close(context.Background())
+		newMod, initErr := p.instantiate(context.Background())
+		if initErr != nil {
+			p.pool <- nil
+			log.Printf("Reinit wasm plugin error: %+v", initErr)
+			return nil, fmt.Errorf("%s: %v (reinit: %v)", p.path, err, initErr)
+		}
+		mod = newMod
+	}
+	p.pool <- mod
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p.path, err)
+	}
+
+	res := result{}
+	if json.Unmarshal(out, &res) == nil && res.Error != "" {
+		return nil, fmt.Errorf("%s: %s", p.path, res.Error)
+	}
+
+	var mDatas []dbMigration.MigrationData
+	if err := json.Unmarshal(out, &mDatas); err != nil {
+		return nil, fmt.Errorf("%s: unmarshal result: %v", p.path, err)
+	}
+
+	return mDatas, nil
+}
+
+func (p *Plugin) call(ctx context.Context, mod api.Module, in []byte) ([]byte, error) {
+
+	res, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+	inPtr := uint32(res[0])
+	if !mod.Memory().Write(inPtr, in) {
+		return nil, errors.New("input out of memory range")
+	}
+
+	res, err = mod.ExportedFunction("migration").Call(ctx, uint64(inPtr), uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+
+	view, ok := mod.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, errors.New("output out of memory range")
+	}
+	out := make([]byte, len(view))
+	copy(out, view)
+
+	if dealloc := mod.ExportedFunction("dealloc"); dealloc != nil {
+		if _, err := dealloc.Call(ctx, uint64(inPtr), uint64(len(in))); err != nil {
+			return nil, err
+		}
+		if _, err := dealloc.Call(ctx, uint64(outPtr), uint64(outLen)); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+func (p *Plugin) Close() {
+
+	if p.runtime != nil {
+		p.runtime.Close(context.Background())
+	}
+}
@@ -0,0 +1,157 @@
+package wasmPlugin
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meepshop/go-db-migration/pkg/dbMigration"
+)
+
+const output = `[{"table":"t","action":"UPSERT","id":"1","data":"{}"}]`
+
+// section 組成 WASM section，內容皆小於 128 bytes
+func section(id byte, content ...byte) []byte {
+	return append([]byte{id, byte(len(content))}, content...)
+}
+
+// testModule 測試用的 plugin：輸入以 L 開頭時無窮迴圈，以 T 開頭時 trap，其餘回傳 output
+func testModule() []byte {
+
+	b := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+	// (i32) -> i32, (i32, i32) -> i64
+	b = append(b, section(1, 0x02, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e)...)
+	b = append(b, section(3, 0x02, 0x00, 0x01)...)
+	b = append(b, section(5, 0x01, 0x00, 0x01)...)
+	b = append(b, section(7,
+		0x03,
+		0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+		0x05, 'a', 'l', 'l', 'o', 'c', 0x00, 0x00,
+		0x09, 'm', 'i', 'g', 'r', 'a', 't', 'i', 'o', 'n', 0x00, 0x01,
+	)...)
+
+	alloc := []byte{
+		0x00,
+		0x41, 0x80, 0x08, // i32.const 1024
+		0x0b,
+	}
+	migration := []byte{
+		0x00,
+		0x20, 0x00, 0x2d, 0x00, 0x00, 0x41, 0xcc, 0x00, 0x46, // i32.load8_u (ptr) == 'L'
+		0x04, 0x40, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b, // if { loop { br 0 } }
+		0x20, 0x00, 0x2d, 0x00, 0x00, 0x41, 0xd4, 0x00, 0x46, // i32.load8_u (ptr) == 'T'
+		0x04, 0x40, 0x00, 0x0b, // if { unreachable }
+		0x42, byte(len(output)), // i64.const (0 << 32 | len)
+		0x0b,
+	}
+	code := []byte{0x02, byte(len(alloc))}
+	code = append(code, alloc...)
+	code = append(code, byte(len(migration)))
+	code = append(code, migration...)
+	b = append(b, section(10, code...)...)
+
+	data := []byte{0x01, 0x00, 0x41, 0x00, 0x0b, byte(len(output))}
+	b = append(b, section(11, append(data, output...)...)...)
+
+	return b
+}
+
+func load(t *testing.T, timeout time.Duration) *Plugin {
+
+	dir, err := ioutil.TempDir("", "wasmPlugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "plugin.wasm")
+	if err := ioutil.WriteFile(path, testModule(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Load(path, 1, 1, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func TestTransform(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		data    string
+		timeout time.Duration
+		cancel  bool
+		err     string
+	}{
+		{name: "ok", data: "{}"},
+		{name: "trap", data: "T", err: "unreachable"},
+		{name: "timeout", data: "L", timeout: 100 * time.Millisecond, err: "deadline exceeded"},
+		{name: "canceled", data: "L", cancel: true, err: "canceled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			p := load(t, tt.timeout)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(100*time.Millisecond, cancel)
+			}
+
+			mDatas, err := p.Transform(ctx, dbMigration.Row{Id: "1", Data: tt.data})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if len(mDatas) != 1 || mDatas[0].Id != "1" {
+				t.Fatalf("Transform = %+v", mDatas)
+			}
+
+			// 錯誤後以新的 instance 取代，下一筆仍可執行
+			if _, err := p.Transform(context.Background(), dbMigration.Row{Id: "2", Data: "{}"}); err != nil {
+				t.Fatalf("Transform after %s: %v", tt.name, err)
+			}
+		})
+	}
+}
+
+func TestTransformReinitError(t *testing.T) {
+
+	p := load(t, 100*time.Millisecond)
+
+	// 關閉 runtime 後執行失敗且無法重建 instance，錯誤需同時包含兩者
+	p.runtime.Close(context.Background())
+
+	_, err := p.Transform(context.Background(), dbMigration.Row{Id: "1", Data: "{}"})
+	if err == nil || !strings.Contains(err.Error(), p.path) || !strings.Contains(err.Error(), "reinit") {
+		t.Fatalf("err = %v, want both the call and reinit errors", err)
+	}
+
+	// pool 保留位置，下一次呼叫回報重建的錯誤而不是卡住
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.Transform(context.Background(), dbMigration.Row{Id: "2", Data: "{}"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected reinit error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Transform blocked on an empty pool")
+	}
+}